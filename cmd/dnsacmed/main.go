@@ -4,8 +4,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
 	"syscall"
 
@@ -24,11 +27,19 @@ var defaultConfig = map[string]interface{}{
 	"dns.listen":               "0.0.0.0:53",
 	"dns.protocol":             "both",
 	"dns.records":              []string{},
+	"dns.rate_limit.slip":      2,
+	"dns.cookies.enabled":      true,
+	"dns.dnstap.enabled":       true,
+	"dns.query_log.size":       20,
+	"database.txt_cache_size":  10000,
+	"database.poll_interval":   "10s",
 	"api.listen":               "0.0.0.0:80",
 	"api.disable_registration": false,
 	"api.tls":                  false,
 	"api.use_header":           false,
 	"api.header_name":          "X-Forwarded-For",
+	"api.propagation.timeout":  "60s",
+	"api.propagation.interval": "1s",
 }
 
 func main() {
@@ -38,43 +49,11 @@ func main() {
 	// Created files are not world writable
 	syscall.Umask(0077)
 
-	// Load defaults
-	k := koanf.New(".")
-	if err := k.Load(confmap.Provider(defaultConfig, "."), nil); err != nil {
-		panic(err)
-	}
-
-	// Read in the global config
-	if *configPtr != "" {
-		if err := k.Load(file.Provider(*configPtr), toml.Parser()); err != nil {
-			panic(err)
-		}
-	} else {
-		if err := k.Load(file.Provider("/etc/dnsacmed/config.toml"), toml.Parser()); err != nil {
-			k.Load(file.Provider("config.toml"), toml.Parser())
-		}
-	}
-
-	// Read in environment variables
-	k.Load(env.Provider("DNSACMED_", ".", func(s string) string {
-		return strings.Replace(strings.ToLower(
-			strings.TrimPrefix(s, "DNSACMED_")), "_", ".", -1)
-	}), nil)
-
-	if err := checkConfig(k); err != nil {
+	config, err := readConfig(*configPtr)
+	if err != nil {
 		panic(err)
 	}
 
-	var config Config
-	if k.String("logging.preset") == "development" {
-		config.Logging = zap.NewDevelopmentConfig()
-	} else {
-		config.Logging = zap.NewProductionConfig()
-	}
-	if err := k.UnmarshalWithConf("", &config, koanf.UnmarshalConf{Tag: "json"}); err != nil {
-		panic(fmt.Errorf("Error unmarshaling config file: %w", err))
-	}
-
 	logger, err := config.Logging.Build()
 	if err != nil {
 		panic(err)
@@ -96,36 +75,145 @@ func main() {
 
 	// DNS server
 	dnsservers := make([]*dns.DNSServer, 0)
-	if strings.HasPrefix(config.DNS.Proto, "both") {
-		// Handle the case where DNS server should be started for both udp and tcp
-		udpProto := "udp"
-		tcpProto := "tcp"
-		if strings.HasSuffix(config.DNS.Proto, "4") {
-			udpProto += "4"
-			tcpProto += "4"
-		} else if strings.HasSuffix(config.DNS.Proto, "6") {
-			udpProto += "6"
-			tcpProto += "6"
+	dohservers := make([]*dns.DoHServer, 0)
+	// The "both", "tls" and "https" protocols can be limited to IPv4 or IPv6
+	ipSuffix := ""
+	if strings.HasSuffix(config.DNS.Proto, "4") {
+		ipSuffix = "4"
+	} else if strings.HasSuffix(config.DNS.Proto, "6") {
+		ipSuffix = "6"
+	}
+	var tlsConfig *tls.Config
+	if strings.HasPrefix(config.DNS.Proto, "tls") || strings.HasPrefix(config.DNS.Proto, "https") ||
+		strings.HasPrefix(config.DNS.Proto, "both") && (config.DNS.TLSListen != "" || config.DNS.HTTPSListen != "") {
+		tlsConfig, err = loadTLSConfig(&config.API)
+		if err != nil {
+			logger.Fatal("Could not load certificate for encrypted DNS", zap.Error(err))
+		}
+	}
+	// The servers that parsed the records themselves, the others share theirs
+	primaries := make([]*dns.DNSServer, 0)
+	loadRecords := func(dnsServer *dns.DNSServer) {
+		if err := dnsServer.ParseRecords(&config.DNS); err != nil {
+			logger.Fatal("Could not load records", zap.Error(err))
+		}
+		if err := dnsServer.LoadDNSSECKeys(&config.DNS); err != nil {
+			logger.Fatal("Could not load DNSSEC keys", zap.Error(err))
 		}
-		dnsServerUDP := dns.NewDNSServer(logger, db, config.DNS.Listen, udpProto, config.DNS.Domain)
-		dnsservers = append(dnsservers, dnsServerUDP)
-		dnsServerUDP.ParseRecords(&config.DNS)
-		dnsServerTCP := dns.NewDNSServer(logger, db, config.DNS.Listen, tcpProto, config.DNS.Domain)
-		dnsservers = append(dnsservers, dnsServerTCP)
+		primaries = append(primaries, dnsServer)
+	}
+	// Query logging in dnstap format
+	var tap *dns.Dnstap
+	if config.DNS.Dnstap.Socket != "" || config.DNS.Dnstap.File != "" {
+		tap, err = dns.NewDnstap(logger, &config.DNS)
+		if err != nil {
+			logger.Fatal("Could not set up dnstap", zap.Error(err))
+		}
+		defer tap.Close()
+	}
+	// Recent queries for each account, shared by all servers
+	queryLog := dns.NewQueryLog(&config.DNS)
+	// All servers answering queries, including the one behind DNS over HTTPS only
+	configured := make([]*dns.DNSServer, 0)
+	configure := func(dnsServer *dns.DNSServer) {
+		configured = append(configured, dnsServer)
+		dnsServer.Dnstap = tap
+		dnsServer.QueryLog = queryLog
+		if err := dnsServer.ConfigureTransfers(&config.DNS); err != nil {
+			logger.Fatal("Could not configure zone transfers", zap.Error(err))
+		}
+		if err := dnsServer.ConfigureRateLimit(&config.DNS); err != nil {
+			logger.Fatal("Could not configure rate limiting", zap.Error(err))
+		}
+		if err := dnsServer.ConfigureCookies(&config.DNS); err != nil {
+			logger.Fatal("Could not configure DNS cookies", zap.Error(err))
+		}
+		dnsServer.ConfigureIdentity(&config.DNS)
+		if err := dnsServer.ConfigureQueryACL(&config.DNS); err != nil {
+			logger.Fatal("Could not configure the query ACL", zap.Error(err))
+		}
+	}
+	switch {
+	case strings.HasPrefix(config.DNS.Proto, "both"):
+		// Handle the case where DNS server should be started for both udp and tcp
+		dnsServerUDP := dns.NewDNSServer(logger, db, config.DNS.Listen, "udp"+ipSuffix, config.DNS.Domain)
+		loadRecords(dnsServerUDP)
+		dnsServerTCP := dns.NewDNSServer(logger, db, config.DNS.Listen, "tcp"+ipSuffix, config.DNS.Domain)
 		// No need to parse records from config again
-		dnsServerTCP.Domains = dnsServerUDP.Domains
-		dnsServerTCP.SOA = dnsServerUDP.SOA
-		go dnsServerUDP.Start(errChan)
-		go dnsServerTCP.Start(errChan)
-	} else {
+		dnsServerTCP.ShareRecords(dnsServerUDP)
+		dnsservers = append(dnsservers, dnsServerUDP, dnsServerTCP)
+		if config.DNS.TLSListen != "" {
+			dnsServerTLS := dns.NewDNSServer(logger, db, config.DNS.TLSListen, "tcp"+ipSuffix+"-tls", config.DNS.Domain)
+			dnsServerTLS.Server.TLSConfig = tlsConfig
+			dnsServerTLS.ShareRecords(dnsServerUDP)
+			dnsservers = append(dnsservers, dnsServerTLS)
+		}
+		if config.DNS.HTTPSListen != "" {
+			dohservers = append(dohservers, dns.NewDoHServer(dnsServerUDP, config.DNS.HTTPSListen, "tcp"+ipSuffix, tlsConfig))
+		}
+	case strings.HasPrefix(config.DNS.Proto, "tls"):
+		dnsServer := dns.NewDNSServer(logger, db, config.DNS.Listen, "tcp"+ipSuffix+"-tls", config.DNS.Domain)
+		dnsServer.Server.TLSConfig = tlsConfig
+		loadRecords(dnsServer)
+		dnsservers = append(dnsservers, dnsServer)
+	case strings.HasPrefix(config.DNS.Proto, "https"):
+		// This DNS server is never started, it only answers the queries received over HTTPS
+		dnsServer := dns.NewDNSServer(logger, db, config.DNS.Listen, "tcp"+ipSuffix, config.DNS.Domain)
+		loadRecords(dnsServer)
+		configure(dnsServer)
+		dohservers = append(dohservers, dns.NewDoHServer(dnsServer, config.DNS.Listen, "tcp"+ipSuffix, tlsConfig))
+	default:
 		dnsServer := dns.NewDNSServer(logger, db, config.DNS.Listen, config.DNS.Proto, config.DNS.Domain)
+		loadRecords(dnsServer)
 		dnsservers = append(dnsservers, dnsServer)
-		dnsServer.ParseRecords(&config.DNS)
+	}
+	for _, dnsServer := range dnsservers {
+		configure(dnsServer)
 		go dnsServer.Start(errChan)
 	}
+	for _, dohServer := range dohservers {
+		go dohServer.Start(errChan)
+	}
+
+	// Tell the secondaries about zone changes
+	if len(config.DNS.Transfer.Notify) > 0 {
+		notifier := dns.NewNotifier(logger, &config.DNS)
+		defer notifier.Close()
+		db.Subscribe(func(string) {
+			notifier.Notify()
+		})
+		// The static records may have changed since the last start
+		notifier.Notify()
+	}
+
+	// Reload the records and rotate the DNS cookie secret on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			newConfig, err := readConfig(*configPtr)
+			if err != nil {
+				logger.Error("Could not reload config, keeping the old records", zap.Error(err))
+				continue
+			}
+			if tap != nil {
+				tap.Configure(&newConfig.DNS)
+			}
+			for _, dnsServer := range primaries {
+				if err := dnsServer.Reload(&newConfig.DNS); err != nil {
+					logger.Error("Could not reload records, keeping the old ones", zap.Error(err))
+				}
+			}
+			for _, dnsServer := range configured {
+				if err := dnsServer.RotateCookieSecret(&newConfig.DNS); err != nil {
+					logger.Error("Could not rotate the DNS cookie secret, keeping the old one", zap.Error(err))
+				}
+			}
+		}
+	}()
 
 	// HTTP API
-	go api.StartHTTPAPI(errChan, &config.API, &config.DNS, logger, db, dnsservers)
+	go api.StartHTTPAPI(errChan, &config.API, &config.DNS, logger, db, configured, queryLog)
 
 	// block waiting for error
 	for {
@@ -135,6 +223,68 @@ func main() {
 	}
 }
 
+// readConfig reads the defaults, the config file and the environment, in order of
+// increasing precedence
+func readConfig(path string) (Config, error) {
+	var config Config
+
+	// Load defaults
+	k := koanf.New(".")
+	if err := k.Load(confmap.Provider(defaultConfig, "."), nil); err != nil {
+		return config, err
+	}
+
+	// Read in the global config
+	if path != "" {
+		if err := k.Load(file.Provider(path), toml.Parser()); err != nil {
+			return config, err
+		}
+	} else {
+		if err := k.Load(file.Provider("/etc/dnsacmed/config.toml"), toml.Parser()); err != nil {
+			k.Load(file.Provider("config.toml"), toml.Parser())
+		}
+	}
+
+	// Read in environment variables
+	k.Load(env.Provider("DNSACMED_", ".", func(s string) string {
+		return strings.Replace(strings.ToLower(
+			strings.TrimPrefix(s, "DNSACMED_")), "_", ".", -1)
+	}), nil)
+
+	if err := checkConfig(k); err != nil {
+		return config, err
+	}
+
+	if k.String("logging.preset") == "development" {
+		config.Logging = zap.NewDevelopmentConfig()
+	} else {
+		config.Logging = zap.NewProductionConfig()
+	}
+	if err := k.UnmarshalWithConf("", &config, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+		return config, fmt.Errorf("Error unmarshaling config file: %w", err)
+	}
+	config.DNS.SetDefaults()
+	if err := config.DNS.Validate(); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// loadTLSConfig loads the API certificate for the encrypted DNS listeners
+func loadTLSConfig(config *api.Config) (*tls.Config, error) {
+	if config.TLSCertFullchain == "" || config.TLSCertPrivkey == "" {
+		return nil, fmt.Errorf("Options api.tls_cert_fullchain and api.tls_cert_privkey are required for DNS over TLS and HTTPS")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFullchain, config.TLSCertPrivkey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
 func checkConfig(k *koanf.Koanf) error {
 	for _, key := range []string{
 		"dns.domain",
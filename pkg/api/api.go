@@ -3,9 +3,11 @@ package api
 import (
 	"crypto/tls"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/jdpage/dnsacmed/pkg/db"
 	"github.com/jdpage/dnsacmed/pkg/dns"
@@ -20,6 +22,9 @@ type RegResponse struct {
 	Fulldomain string          `json:"fulldomain"`
 	Subdomain  string          `json:"subdomain"`
 	Allowfrom  model.CIDRSlice `json:"allowfrom"`
+	// TSIGKey and TSIGSecret authenticate RFC 2136 updates of the TXT record
+	TSIGKey    string `json:"tsig_key"`
+	TSIGSecret string `json:"tsig_secret"`
 }
 
 type webRegisterHandler struct {
@@ -57,8 +62,21 @@ func (h webRegisterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	zone := h.dnsConfig.Domain
+	if aTXT.Zone != "" {
+		zone = aTXT.Zone
+	}
+	zone = dns.NormalizeZone(zone)
+	if !h.dnsConfig.HasZone(zone) || !h.registrationAllowed(zone) {
+		h.logger.Debug("Bad registration data", zap.String("error", "zone"), zap.String("zone", zone))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_zone"))
+		return
+	}
+
 	// Create new user
-	nu, err := h.db.Register(aTXT.AllowFrom)
+	nu, err := h.db.Register(aTXT.AllowFrom, zone)
 	if err != nil {
 		errstr := fmt.Sprintf("%v", err)
 		reg = jsonError(errstr)
@@ -66,7 +84,15 @@ func (h webRegisterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.logger.Debug("Error in registration", zap.Error(err))
 	} else {
 		h.logger.Debug("Created new user", zap.Any("user", nu.Username))
-		regStruct := RegResponse{nu.Username.String(), nu.Password, nu.Subdomain + "." + h.dnsConfig.Domain, nu.Subdomain, nu.AllowFrom}
+		regStruct := RegResponse{
+			Username:   nu.Username.String(),
+			Password:   nu.Password,
+			Fulldomain: nu.Subdomain + "." + zone,
+			Subdomain:  nu.Subdomain,
+			Allowfrom:  nu.AllowFrom,
+			TSIGKey:    nu.Username.String() + ".",
+			TSIGSecret: nu.TSIGSecret,
+		}
 		regStatus = http.StatusCreated
 		reg, err = json.Marshal(regStruct)
 		if err != nil {
@@ -80,6 +106,19 @@ func (h webRegisterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(reg)
 }
 
+// registrationAllowed checks if accounts may be registered in the zone
+func (h webRegisterHandler) registrationAllowed(zone string) bool {
+	if len(h.config.RegistrationZones) == 0 {
+		return true
+	}
+	for _, z := range h.config.RegistrationZones {
+		if dns.NormalizeZone(z) == zone {
+			return true
+		}
+	}
+	return false
+}
+
 type webUpdateHandler struct {
 	logger *zap.Logger
 	db     db.Database
@@ -127,6 +166,42 @@ func (h webUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(upd)
 }
 
+// QueriesResponse lists the recent queries for the name of an account
+type QueriesResponse struct {
+	Subdomain string              `json:"subdomain"`
+	Queries   []dns.QueryLogEntry `json:"queries"`
+}
+
+// Endpoint used by account owners to see the recent queries for their account,
+// eg. to check if the CA queried the server during a failed validation
+type queriesHandler struct {
+	logger   *zap.Logger
+	queryLog *dns.QueryLog
+}
+
+func (h queriesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a, ok := r.Context().Value(ACMETxtKey).(*model.ACMETxt)
+	if !ok {
+		h.logger.Error("Context error", zap.String("error", "context"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(QueriesResponse{Subdomain: a.Subdomain, Queries: h.queryLog.Queries(a.Subdomain)})
+	if err != nil {
+		h.logger.Error("Could not marshal JSON", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
 // Endpoint used to check the readiness and/or liveness (health) of the server.
 type healthCheckHandler struct {
 	logger *zap.Logger
@@ -149,7 +224,37 @@ func (h healthCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func StartHTTPAPI(errChan chan error, config *Config, dnsConfig *dns.Config, logger *zap.Logger, db db.Database, dnsservers []*dns.DNSServer) {
+// Endpoint publishing the counters of the DNS server and the database. Unlike
+// expvar.Handler, it leaves out the variables describing the process, such as its
+// command line and memory statistics.
+type metricsHandler struct{}
+
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !strings.HasPrefix(kv.Key, "dns_") && !strings.HasPrefix(kv.Key, "db_") {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// StartHTTPAPI serves the HTTP API. The queries endpoint is only served if a query
+// log is given. The propagation endpoint asks the first of the DNS servers directly.
+func StartHTTPAPI(errChan chan error, config *Config, dnsConfig *dns.Config, logger *zap.Logger, db db.Database, dnsservers []*dns.DNSServer, queryLog *dns.QueryLog) {
 	api := http.NewServeMux()
 	if !config.DisableRegistration {
 		api.Handle("/register", webRegisterHandler{config, dnsConfig, logger, db})
@@ -157,7 +262,18 @@ func StartHTTPAPI(errChan chan error, config *Config, dnsConfig *dns.Config, log
 	api.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
 		authMiddleware{config, logger, db}.ServeHTTP(w, r, webUpdateHandler{logger, db}.ServeHTTP)
 	})
+	if queryLog != nil {
+		api.HandleFunc("/queries", func(w http.ResponseWriter, r *http.Request) {
+			authMiddleware{config, logger, db}.authenticate(w, r, queriesHandler{logger, queryLog}.ServeHTTP)
+		})
+	}
+	api.HandleFunc("/propagation", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware{config, logger, db}.authenticate(w, r, propagationHandler{config, dnsConfig, logger, propagationNodes(config, dnsConfig, dnsservers)}.ServeHTTP)
+	})
 	api.Handle("/health", healthCheckHandler{logger, db})
+	if config.Metrics {
+		api.Handle("/debug/vars", metricsHandler{})
+	}
 
 	errorLog, err := zap.NewStdLogAt(logger, zap.ErrorLevel)
 	if err != nil {
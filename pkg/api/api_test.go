@@ -13,6 +13,7 @@ import (
 	"github.com/gavv/httpexpect/v2"
 	"github.com/google/uuid"
 	"github.com/jdpage/dnsacmed/pkg/db"
+	"github.com/jdpage/dnsacmed/pkg/dns"
 	"github.com/jdpage/dnsacmed/pkg/model"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
@@ -50,8 +51,9 @@ func getExpect(t *testing.T, server *httptest.Server) *httpexpect.Expect {
 }
 
 type routerOpts struct {
-	noAuth    bool
-	useHeader bool
+	noAuth            bool
+	useHeader         bool
+	registrationZones []string
 }
 
 type routerOpt func(opts routerOpts) routerOpts
@@ -66,6 +68,13 @@ func useHeader(opts routerOpts) routerOpts {
 	return opts
 }
 
+func registrationZones(zones ...string) routerOpt {
+	return func(opts routerOpts) routerOpts {
+		opts.registrationZones = zones
+		return opts
+	}
+}
+
 func setupRouter(logger *zap.Logger, db db.Database, opts ...routerOpt) http.Handler {
 	var options routerOpts
 	for _, opt := range opts {
@@ -73,9 +82,15 @@ func setupRouter(logger *zap.Logger, db db.Database, opts ...routerOpt) http.Han
 	}
 
 	config, dnsConfig := setupConfigs(options.useHeader)
+	config.RegistrationZones = options.registrationZones
 	api := http.NewServeMux()
 	api.Handle("/register", webRegisterHandler{&config, &dnsConfig, logger, db})
 	api.Handle("/health", healthCheckHandler{logger, db})
+	api.Handle("/debug/vars", metricsHandler{})
+	dnsConfig.QueryLog.Size = 10
+	api.HandleFunc("/queries", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware{&config, logger, db}.authenticate(w, r, queriesHandler{logger, dns.NewQueryLog(&dnsConfig)}.ServeHTTP)
+	})
 	if options.noAuth {
 		api.HandleFunc("/update", noAuthMiddleware(webUpdateHandler{logger, db}.ServeHTTP))
 	} else {
@@ -100,6 +115,8 @@ func TestApiRegister(t *testing.T) {
 		ContainsKey("subdomain").
 		ContainsKey("username").
 		ContainsKey("password").
+		ContainsKey("tsig_key").
+		ContainsKey("tsig_secret").
 		NotContainsKey("error")
 
 	allowfrom := map[string][]interface{}{
@@ -125,6 +142,48 @@ func TestApiRegister(t *testing.T) {
 	response.Value("allowfrom").Array().Elements("123.123.123.123/32", "2001:db8::/32", "::/64")
 }
 
+func TestApiRegisterZone(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	router := setupRouter(logger, db, registrationZones("auth.example.org", "acme.eu.example.com"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	response := e.POST("/register").Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	response.Value("fulldomain").String().Equal(response.Value("subdomain").String().Raw() + ".auth.example.org")
+
+	response = e.POST("/register").
+		WithJSON(map[string]interface{}{"zone": "ACME.eu.example.com."}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	response.Value("fulldomain").String().Equal(response.Value("subdomain").String().Raw() + ".acme.eu.example.com")
+
+	user, err := uuid.Parse(response.Value("username").String().Raw())
+	if err != nil {
+		t.Fatalf("Could not parse username: [%v]", err)
+	}
+	reg, err := db.GetByUsername(user)
+	if err != nil {
+		t.Fatalf("Could not get registered user: [%v]", err)
+	}
+	if reg.Zone != "acme.eu.example.com" {
+		t.Errorf("Expected account to be stored in zone acme.eu.example.com, but got [%s]", reg.Zone)
+	}
+
+	for _, zone := range []string{"acme.us.example.com", "unknown.example.com"} {
+		e.POST("/register").
+			WithJSON(map[string]interface{}{"zone": zone}).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("error", "invalid_zone")
+	}
+}
+
 func TestApiRegisterBadAllowFrom(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 	db := setupDB(t, logger)
@@ -216,7 +275,7 @@ func TestApiUpdateWithInvalidSubdomain(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := db.Register(model.CIDRSlice{})
+	newUser, err := db.Register(model.CIDRSlice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -248,7 +307,7 @@ func TestApiUpdateWithInvalidTxt(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := db.Register(model.CIDRSlice{})
+	newUser, err := db.Register(model.CIDRSlice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -294,7 +353,7 @@ func TestApiUpdateWithCredentials(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := db.Register(model.CIDRSlice{})
+	newUser, err := db.Register(model.CIDRSlice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -313,6 +372,37 @@ func TestApiUpdateWithCredentials(t *testing.T) {
 		ValueEqual("txt", validTxtData)
 }
 
+func TestApiQueries(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	router := setupRouter(logger, db)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Errorf("Could not create new user, got error [%v]", err)
+	}
+	e.GET("/queries").
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("subdomain", newUser.Subdomain).
+		Value("queries").Array().Empty()
+	e.GET("/queries").
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.POST("/queries").
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusMethodNotAllowed)
+}
+
 func TestApiUpdateWithCredentialsMockDB(t *testing.T) {
 	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
 	updateJSON := map[string]interface{}{
@@ -351,7 +441,7 @@ func TestApiManyUpdateWithCredentials(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	// User without defined CIDR masks
-	newUser, err := db.Register(model.CIDRSlice{})
+	newUser, err := db.Register(model.CIDRSlice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -359,14 +449,14 @@ func TestApiManyUpdateWithCredentials(t *testing.T) {
 	// User with defined allow from - CIDR masks, all invalid
 	// (httpexpect doesn't provide a way to mock remote ip)
 	cidrs, _ := model.ParseCIDRSlice([]string{"192.168.1.1/32", "invalid"})
-	newUserWithCIDR, err := db.Register(cidrs)
+	newUserWithCIDR, err := db.Register(cidrs, "")
 	if err != nil {
 		t.Errorf("Could not create new user with CIDR, got error [%v]", err)
 	}
 
 	// Another user with valid CIDR mask to match the httpexpect default
 	cidrs, _ = model.ParseCIDRSlice([]string{"10.1.2.3/32", "invalid"})
-	newUserWithValidCIDR, err := db.Register(cidrs)
+	newUserWithValidCIDR, err := db.Register(cidrs, "")
 	if err != nil {
 		t.Errorf("Could not create new user with a valid CIDR, got error [%v]", err)
 	}
@@ -414,19 +504,19 @@ func TestApiManyUpdateWithIpCheckHeaders(t *testing.T) {
 	defer server.Close()
 	e := getExpect(t, server)
 	// User without defined CIDR masks
-	newUser, err := db.Register(model.CIDRSlice{})
+	newUser, err := db.Register(model.CIDRSlice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
 
 	cidrs, _ := model.ParseCIDRSlice([]string{"192.168.1.2/32", "invalid"})
-	newUserWithCIDR, err := db.Register(cidrs)
+	newUserWithCIDR, err := db.Register(cidrs, "")
 	if err != nil {
 		t.Errorf("Could not create new user with CIDR, got error [%v]", err)
 	}
 
 	cidrs, _ = model.ParseCIDRSlice([]string{"2002:c0a8::0/32"})
-	newUserWithIP6CIDR, err := db.Register(cidrs)
+	newUserWithIP6CIDR, err := db.Register(cidrs, "")
 	if err != nil {
 		t.Errorf("Could not create a new user with IP6 CIDR, got error [%v]", err)
 	}
@@ -467,3 +557,16 @@ func TestApiHealthCheck(t *testing.T) {
 	e := getExpect(t, server)
 	e.GET("/health").Expect().Status(http.StatusOK)
 }
+
+func TestApiMetrics(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	router := setupRouter(logger, db)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	vars := e.GET("/debug/vars").Expect().Status(http.StatusOK).JSON().Object()
+	vars.ContainsKey("dns_rate_limit_dropped").ContainsKey("db_txt_cache_hits")
+	vars.NotContainsKey("cmdline").NotContainsKey("memstats")
+	e.POST("/debug/vars").Expect().Status(http.StatusMethodNotAllowed)
+}
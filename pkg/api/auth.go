@@ -61,6 +61,23 @@ func (m authMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next h
 	}
 }
 
+// authenticate checks the credentials and source address of a request without a
+// body, passing the account on to the next handler in the context
+func (m authMiddleware) authenticate(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	user, err := m.getUserFromRequest(r)
+	if err != nil {
+		m.logger.Error("Error while trying to get user", zap.Error(err))
+	} else if !m.updateAllowedFromIP(r, user) {
+		m.logger.Error("Request not allowed from IP", zap.String("error", "ip_unauthorized"))
+	} else {
+		next(w, r.WithContext(context.WithValue(r.Context(), ACMETxtKey, user)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write(jsonError("forbidden"))
+}
+
 func (m authMiddleware) getUserFromRequest(r *http.Request) (*model.ACMETxt, error) {
 	uname := r.Header.Get("X-Api-User")
 	passwd := r.Header.Get("X-Api-Key")
@@ -17,7 +17,6 @@ var records = []string{
 	"auth.example.org. A 192.168.1.100",
 	"ns1.auth.example.org. A 192.168.1.101",
 	"cn.example.org CNAME something.example.org.",
-	"!''b', unparseable ",
 	"ns2.auth.example.org. A 192.168.1.102",
 }
 
@@ -66,6 +65,10 @@ func setupConfigs(useHeader bool) (Config, dns.Config) {
 		NSName:        "ns1.auth.example.org",
 		NSAdmin:       "admin.example.org",
 		StaticRecords: records,
+		Zones: []dns.ZoneConfig{
+			{Domain: "acme.eu.example.com", NSName: "ns1.acme.eu.example.com", NSAdmin: "admin.example.com"},
+			{Domain: "acme.us.example.com", NSName: "ns1.acme.us.example.com", NSAdmin: "admin.example.com"},
+		},
 	}
 
 	return config, dnsConfig
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jdpage/dnsacmed/pkg/dns"
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"go.uber.org/zap"
+)
+
+// Defaults for the propagation options, used when an option is unset
+const (
+	DefaultPropagationTimeout  = time.Minute
+	DefaultPropagationInterval = time.Second
+)
+
+// PropagationResponse tells whether every node serves the TXT value of an account
+type PropagationResponse struct {
+	Fulldomain string       `json:"fulldomain"`
+	TXT        string       `json:"txt"`
+	Propagated bool         `json:"propagated"`
+	Nodes      []NodeStatus `json:"nodes"`
+}
+
+// NodeStatus tells whether one DNS server serves the value, or why it couldn't be
+// asked the last time
+type NodeStatus struct {
+	Address    string `json:"address"`
+	Propagated bool   `json:"propagated"`
+	Error      string `json:"error,omitempty"`
+}
+
+// propagationNode is a DNS server asked for the values of an account. The DNS server
+// of this node is asked directly rather than over the network, so that the query ACL
+// and rate limiting don't apply to its own checks.
+type propagationNode struct {
+	network string
+	addr    string
+	local   *dns.DNSServer
+}
+
+// propagationNodes returns the DNS server of this node, if any, and those of the peers
+func propagationNodes(config *Config, dnsConfig *dns.Config, dnsservers []*dns.DNSServer) []propagationNode {
+	var nodes []propagationNode
+	if len(dnsservers) > 0 {
+		nodes = append(nodes, propagationNode{addr: dnsConfig.Listen, local: dnsservers[0]})
+	}
+	for _, peer := range config.Propagation.Peers {
+		nodes = append(nodes, propagationNode{network: "udp", addr: peer})
+	}
+	return nodes
+}
+
+// values returns the TXT values the node serves at the name
+func (n propagationNode) values(ctx context.Context, name string) ([]string, error) {
+	if n.local != nil {
+		return n.local.TXTValues(name)
+	}
+	return dns.QueryTXT(ctx, n.network, n.addr, name)
+}
+
+// Endpoint used to wait until the DNS servers of all nodes serve a new TXT value of
+// the account, before asking the CA to validate it
+type propagationHandler struct {
+	config    *Config
+	dnsConfig *dns.Config
+	logger    *zap.Logger
+	nodes     []propagationNode
+}
+
+func (h propagationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a, ok := r.Context().Value(ACMETxtKey).(*model.ACMETxt)
+	if !ok {
+		h.logger.Error("Context error", zap.String("error", "context"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	txt := r.URL.Query().Get("txt")
+	if !validTXT(txt) {
+		h.logger.Debug("Bad propagation request", zap.String("error", "txt"), zap.String("txt", txt))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("bad_txt"))
+		return
+	}
+	timeout := h.config.Propagation.Timeout
+	if timeout <= 0 {
+		timeout = DefaultPropagationTimeout
+	}
+	if param := r.URL.Query().Get("timeout"); param != "" {
+		requested, err := time.ParseDuration(param)
+		if err != nil || requested <= 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(jsonError("bad_timeout"))
+			return
+		}
+		if requested < timeout {
+			timeout = requested
+		}
+	}
+
+	zone := a.Zone
+	if zone == "" {
+		zone = dns.NormalizeZone(h.dnsConfig.Domain)
+	}
+	res := PropagationResponse{Fulldomain: a.Subdomain + "." + zone, TXT: txt}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	res.Nodes = h.wait(ctx, res.Fulldomain, txt)
+	// Without nodes to ask, nothing is known to serve the value
+	res.Propagated = len(res.Nodes) > 0
+	for _, node := range res.Nodes {
+		res.Propagated = res.Propagated && node.Propagated
+	}
+	body, err := json.Marshal(res)
+	if err != nil {
+		h.logger.Error("Could not marshal JSON", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if !res.Propagated {
+		status = http.StatusGatewayTimeout
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// wait asks every node for the values at the name until it serves the value or the
+// context is done
+func (h propagationHandler) wait(ctx context.Context, name string, txt string) []NodeStatus {
+	interval := h.config.Propagation.Interval
+	if interval <= 0 {
+		interval = DefaultPropagationInterval
+	}
+	statuses := make([]NodeStatus, len(h.nodes))
+	var wg sync.WaitGroup
+	for i, node := range h.nodes {
+		wg.Add(1)
+		go func(status *NodeStatus, node propagationNode) {
+			defer wg.Done()
+			status.Address = node.addr
+			answered := false
+			for {
+				values, err := node.values(ctx, name)
+				if err != nil {
+					if ctx.Err() == nil {
+						status.Error = err.Error()
+					} else if !answered && status.Error == "" {
+						status.Error = "no answer before the timeout"
+					}
+				} else {
+					answered = true
+					status.Error = ""
+				}
+				for _, v := range values {
+					if v == txt {
+						status.Propagated = true
+						return
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		}(&statuses[i], node)
+	}
+	wg.Wait()
+	return statuses
+}
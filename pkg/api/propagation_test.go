@@ -0,0 +1,176 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jdpage/dnsacmed/pkg/dns"
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPropagationNodes(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	dnsConfig := dns.Config{Listen: "0.0.0.0:853", Proto: "tls", Domain: "auth.example.org"}
+	local := dns.NewDNSServer(logger, nil, dnsConfig.Listen, "tcp-tls", dnsConfig.Domain)
+	peer := propagationNode{network: "udp", addr: "192.0.2.2:53"}
+	for _, test := range []struct {
+		name       string
+		dnsservers []*dns.DNSServer
+		peers      []string
+		nodes      []propagationNode
+	}{
+		{"local", []*dns.DNSServer{local}, nil, []propagationNode{{addr: "0.0.0.0:853", local: local}}},
+		{"local and peer", []*dns.DNSServer{local}, []string{"192.0.2.2:53"}, []propagationNode{{addr: "0.0.0.0:853", local: local}, peer}},
+		{"peer", nil, []string{"192.0.2.2:53"}, []propagationNode{peer}},
+		{"none", nil, nil, nil},
+	} {
+		config := Config{Propagation: PropagationConfig{Peers: test.peers}}
+		if nodes := propagationNodes(&config, &dnsConfig, test.dnsservers); !reflect.DeepEqual(nodes, test.nodes) {
+			t.Errorf("Expected nodes %v for %s, but got %v", test.nodes, test.name, nodes)
+		}
+	}
+}
+
+func TestApiPropagation(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	config, dnsConfig := setupConfigs(false)
+	config.Propagation = PropagationConfig{Timeout: 5 * time.Second, Interval: 50 * time.Millisecond}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: [%v]", err)
+	}
+	dnsServer := dns.NewDNSServerOnPacketConn(logger, db, conn, dnsConfig.Domain)
+	if err := dnsServer.ParseRecords(&dnsConfig); err != nil {
+		t.Fatalf("Could not load records: [%v]", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	dnsServer.Server.NotifyStartedFunc = wg.Done
+	go dnsServer.Start(make(chan error, 1))
+	wg.Wait()
+	defer func() { _ = dnsServer.Server.Shutdown() }()
+
+	nodes := []propagationNode{{network: "udp", addr: conn.LocalAddr().String()}}
+	api := http.NewServeMux()
+	api.HandleFunc("/propagation", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware{&config, logger, db}.authenticate(w, r, propagationHandler{&config, &dnsConfig, logger, nodes}.ServeHTTP)
+	})
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	newUser, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	newUser.Value = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	if err := db.Update(&newUser.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update TXT, got error [%v]", err)
+	}
+
+	propagated := e.GET("/propagation").
+		WithQuery("txt", newUser.Value).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	propagated.ValueEqual("fulldomain", newUser.Subdomain+".auth.example.org").
+		ValueEqual("propagated", true)
+	node := propagated.Value("nodes").Array().First().Object()
+	node.ValueEqual("address", conn.LocalAddr().String()).
+		ValueEqual("propagated", true).
+		NotContainsKey("error")
+
+	// A value that is not served times out
+	e.GET("/propagation").
+		WithQuery("txt", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb").
+		WithQuery("timeout", "200ms").
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusGatewayTimeout).
+		JSON().Object().
+		ValueEqual("propagated", false).
+		Value("nodes").Array().First().Object().ValueEqual("propagated", false)
+
+	for _, query := range []map[string]string{
+		{},
+		{"txt": "too short"},
+		{"txt": newUser.Value, "timeout": "soon"},
+	} {
+		req := e.GET("/propagation").
+			WithHeader("X-Api-User", newUser.Username.String()).
+			WithHeader("X-Api-Key", newUser.Password)
+		for k, v := range query {
+			req = req.WithQuery(k, v)
+		}
+		req.Expect().Status(http.StatusBadRequest)
+	}
+
+	e.GET("/propagation").
+		WithQuery("txt", newUser.Value).
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestApiPropagationLocal(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	config, dnsConfig := setupConfigs(false)
+	config.Propagation = PropagationConfig{Timeout: 200 * time.Millisecond, Interval: 50 * time.Millisecond}
+	// The local check doesn't query over the network, so the ACL doesn't refuse it
+	dnsConfig.QueryACL.AllowFrom = []string{"192.0.2.0/24"}
+	dnsServer := dns.NewDNSServer(logger, db, "127.0.0.1:0", "udp", dnsConfig.Domain)
+	if err := dnsServer.ParseRecords(&dnsConfig); err != nil {
+		t.Fatalf("Could not load records: [%v]", err)
+	}
+	if err := dnsServer.ConfigureQueryACL(&dnsConfig); err != nil {
+		t.Fatalf("Could not configure the query ACL: [%v]", err)
+	}
+
+	newUser, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	newUser.Value = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	if err := db.Update(&newUser.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update TXT, got error [%v]", err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		dnsservers []*dns.DNSServer
+		status     int
+		propagated bool
+	}{
+		{"local", []*dns.DNSServer{dnsServer}, http.StatusOK, true},
+		{"no nodes", nil, http.StatusGatewayTimeout, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			nodes := propagationNodes(&config, &dnsConfig, test.dnsservers)
+			api := http.NewServeMux()
+			api.HandleFunc("/propagation", func(w http.ResponseWriter, r *http.Request) {
+				authMiddleware{&config, logger, db}.authenticate(w, r, propagationHandler{&config, &dnsConfig, logger, nodes}.ServeHTTP)
+			})
+			server := httptest.NewServer(api)
+			defer server.Close()
+			getExpect(t, server).GET("/propagation").
+				WithQuery("txt", newUser.Value).
+				WithHeader("X-Api-User", newUser.Username.String()).
+				WithHeader("X-Api-Key", newUser.Password).
+				Expect().
+				Status(test.status).
+				JSON().Object().
+				ValueEqual("propagated", test.propagated)
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package api
 
+import "time"
+
 // API config
 type Config struct {
 	Listen              string `json:"listen"`
@@ -9,4 +11,23 @@ type Config struct {
 	TLSCertFullchain    string `json:"tls_cert_fullchain"`
 	UseHeader           bool   `json:"use_header"`
 	HeaderName          string `json:"header_name"`
+	// RegistrationZones restricts the zones accounts can be registered in. All
+	// configured zones are allowed if empty.
+	RegistrationZones []string `json:"registration_zones"`
+	// Metrics publishes server counters at /debug/vars
+	Metrics bool `json:"metrics"`
+	// Propagation configures the /propagation endpoint
+	Propagation PropagationConfig `json:"propagation"`
+}
+
+// PropagationConfig controls how the /propagation endpoint checks that the DNS
+// servers of all nodes serve a new value
+type PropagationConfig struct {
+	// Peers lists the DNS servers of the other nodes as host:port, asked over UDP
+	// next to the listener of this node
+	Peers []string `json:"peers"`
+	// Timeout is the longest a request waits for the value
+	Timeout time.Duration `json:"timeout"`
+	// Interval is the time between queries to a node not serving the value yet
+	Interval time.Duration `json:"interval"`
 }
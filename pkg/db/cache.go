@@ -0,0 +1,116 @@
+package db
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// defaultTXTCacheRefresh is used when the TXT cache is enabled but no refresh
+// interval is configured
+const defaultTXTCacheRefresh = time.Minute
+
+// Counters of TXT cache lookups, published with expvar
+var (
+	txtCacheHits   = expvar.NewInt("db_txt_cache_hits")
+	txtCacheMisses = expvar.NewInt("db_txt_cache_misses")
+)
+
+// txtCache holds the zone and TXT values of recently queried subdomains, so that
+// answering DNS queries doesn't need the database. Unknown subdomains are cached too.
+// Entries are dropped when their values change, and read again once they are older
+// than the refresh interval or one of their values expires.
+type txtCache struct {
+	sync.Mutex
+	size    int
+	refresh time.Duration
+	entries map[string]*list.Element
+	// lru holds the entries, most recently used first
+	lru *list.List
+	// generation changes whenever entries are dropped, so that values read from
+	// the database before that are not cached
+	generation uint64
+	now        func() time.Time
+}
+
+type txtCacheEntry struct {
+	subdomain string
+	exists    bool
+	zone      string
+	values    []string
+	// expires is when the first of the values expires, zero if they don't
+	expires time.Time
+}
+
+func newTXTCache(size int, refresh time.Duration) *txtCache {
+	if refresh <= 0 {
+		refresh = defaultTXTCacheRefresh
+	}
+	return &txtCache{
+		size:    size,
+		refresh: refresh,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// get returns the cached entry of a subdomain. On a miss, the generation to pass to
+// put is returned instead.
+func (c *txtCache) get(subdomain string) (*txtCacheEntry, uint64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[subdomain]; ok {
+		entry := e.Value.(*txtCacheEntry)
+		if c.now().Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			txtCacheHits.Add(1)
+			return entry, c.generation, true
+		}
+		c.remove(e)
+	}
+	txtCacheMisses.Add(1)
+	return nil, c.generation, false
+}
+
+// put caches an entry read from the database, unless entries were dropped since the
+// generation was returned by get. The entry is kept until the refresh interval has
+// passed or until its values expire, whichever is earlier.
+func (c *txtCache) put(entry *txtCacheEntry, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if refresh := c.now().Add(c.refresh); entry.expires.IsZero() || refresh.Before(entry.expires) {
+		entry.expires = refresh
+	}
+	if e, ok := c.entries[entry.subdomain]; ok {
+		c.remove(e)
+	}
+	c.entries[entry.subdomain] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops the entry of a subdomain, or all entries if it is empty
+func (c *txtCache) invalidate(subdomain string) {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	if subdomain == "" {
+		c.entries = make(map[string]*list.Element)
+		c.lru.Init()
+		return
+	}
+	if e, ok := c.entries[subdomain]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *txtCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*txtCacheEntry).subdomain)
+}
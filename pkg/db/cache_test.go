@@ -0,0 +1,125 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestTXTCacheEviction(t *testing.T) {
+	c := newTXTCache(2, time.Minute)
+	for _, subdomain := range []string{"a", "b"} {
+		_, generation, _ := c.get(subdomain)
+		c.put(&txtCacheEntry{subdomain: subdomain, exists: true, values: []string{subdomain}}, generation)
+	}
+	// Using a makes b the least recently used entry
+	if entry, _, ok := c.get("a"); !ok || entry.values[0] != "a" {
+		t.Errorf("Expected cached value for a, but got %v", entry)
+	}
+	_, generation, _ := c.get("c")
+	c.put(&txtCacheEntry{subdomain: "c"}, generation)
+	if _, _, ok := c.get("b"); ok {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	for _, subdomain := range []string{"a", "c"} {
+		if _, _, ok := c.get(subdomain); !ok {
+			t.Errorf("Expected entry %s to be cached", subdomain)
+		}
+	}
+}
+
+func TestTXTCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := newTXTCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.put(&txtCacheEntry{subdomain: "refresh", values: []string{"value"}}, 0)
+	c.put(&txtCacheEntry{subdomain: "expires", values: []string{"value"}, expires: now.Add(time.Second)}, 0)
+	if _, _, ok := c.get("expires"); !ok {
+		t.Errorf("Expected entry to be cached before its value expires")
+	}
+	now = now.Add(2 * time.Second)
+	if _, _, ok := c.get("expires"); ok {
+		t.Errorf("Expected entry to be dropped once its value expired")
+	}
+	if _, _, ok := c.get("refresh"); !ok {
+		t.Errorf("Expected entry to be cached until the refresh interval passed")
+	}
+	now = now.Add(time.Minute)
+	if _, _, ok := c.get("refresh"); ok {
+		t.Errorf("Expected entry to be dropped after the refresh interval")
+	}
+}
+
+func TestTXTCacheGeneration(t *testing.T) {
+	c := newTXTCache(10, time.Minute)
+	_, generation, _ := c.get("a")
+	// The values change while the old ones are being read from the database
+	c.invalidate("a")
+	c.put(&txtCacheEntry{subdomain: "a", values: []string{"old"}}, generation)
+	if entry, _, ok := c.get("a"); ok {
+		t.Errorf("Expected values read before invalidation not to be cached, but got %v", entry)
+	}
+}
+
+func TestTXTCacheReadThrough(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db, err := NewACMEDB(logger, Config{Engine: "sqlite3", Connection: ":memory:", TXTCacheSize: 10})
+	if err != nil {
+		t.Fatalf("Could not open database: [%v]", err)
+	}
+	defer db.Close()
+	reg, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+
+	hits, misses := txtCacheHits.Value(), txtCacheMisses.Value()
+	// Unknown subdomains are cached too
+	for i := 0; i < 2; i++ {
+		if txts, err := db.GetTXTForDomain("does-not-exist"); err != nil || len(txts) != 0 {
+			t.Errorf("Expected no values, but got %v [%v]", txts, err)
+		}
+	}
+	if txtCacheHits.Value()-hits != 1 || txtCacheMisses.Value()-misses != 1 {
+		t.Errorf("Expected one miss and one hit, but got %d and %d", txtCacheMisses.Value()-misses, txtCacheHits.Value()-hits)
+	}
+
+	// Updates are visible immediately
+	if _, err = db.GetTXTForDomain(reg.Subdomain); err != nil {
+		t.Fatalf("Unexpected error [%v]", err)
+	}
+	reg.Value = "___validation_token_received_from_the_ca___"
+	if err = db.Update(&reg.ACMETxtPost); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	txts, err := db.GetTXTForDomain(reg.Subdomain)
+	if err != nil || !containsValue(txts, reg.Value) {
+		t.Errorf("Expected updated value, but got %v [%v]", txts, err)
+	}
+
+	// Changes made behind our back are only seen once the entry is refreshed
+	if _, err = db.GetBackend().Exec("UPDATE txt SET Value=''"); err != nil {
+		t.Fatalf("Could not clear values: [%v]", err)
+	}
+	if txts, _ = db.GetTXTForDomain(reg.Subdomain); !containsValue(txts, reg.Value) {
+		t.Errorf("Expected cached value, but got %v", txts)
+	}
+	if err = db.Update(&model.ACMETxtPost{Subdomain: reg.Subdomain, Value: "___another_token_received_from_the_ca______"}); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	if txts, _ = db.GetTXTForDomain(reg.Subdomain); containsValue(txts, reg.Value) {
+		t.Errorf("Expected cleared value to be gone, but got %v", txts)
+	}
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
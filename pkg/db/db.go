@@ -18,7 +18,7 @@ import (
 )
 
 // DBVersion shows the database version this code uses. This is used for update checks.
-var DBVersion = 1
+var DBVersion = 3
 
 var acmeTable = `
 	CREATE TABLE IF NOT EXISTS acmedns(
@@ -49,6 +49,17 @@ var txtTablePG = `
 		LastUpdate INT
 	);`
 
+// defaultJanitorInterval is used when TXT expiry is enabled but no janitor interval is configured
+const defaultJanitorInterval = 10 * time.Minute
+
+// serialBumpSQL increments the zone serial, wrapping around as per RFC 1982
+var serialBumpSQL = `
+	UPDATE acmedns SET Value=CAST((CAST(Value AS BIGINT) + 1) % 4294967296 AS TEXT)
+	WHERE Name='serial'`
+
+// serialLockID identifies the PostgreSQL advisory lock taken while creating the serial
+const serialLockID = 0x646e7361
+
 // getSQLiteStmt replaces all PostgreSQL prepared statement placeholders (eg. $1, $2) with SQLite variant "?"
 func getSQLiteStmt(s string) string {
 	re, _ := regexp.Compile(`\$[0-9]`)
@@ -61,6 +72,11 @@ func NewACMEDB(logger *zap.Logger, config Config) (Database, error) {
 	defer d.Unlock()
 	d.logger = logger
 	d.engine = config.Engine
+	d.txtMaxAge = config.TXTMaxAge
+	if config.TXTCacheSize > 0 {
+		d.cache = newTXTCache(config.TXTCacheSize, config.TXTCacheRefresh)
+	}
+	d.done = make(chan struct{})
 	db, err := sql.Open(config.Engine, config.Connection)
 	if err != nil {
 		return nil, err
@@ -88,9 +104,83 @@ func NewACMEDB(logger *zap.Logger, config Config) (Database, error) {
 		insversion := fmt.Sprintf("INSERT INTO acmedns (Name, Value) values('db_version', '%d')", DBVersion)
 		_, err = db.Exec(insversion)
 	}
+	if err = d.initSerial(); err != nil {
+		return nil, err
+	}
+	switch {
+	case d.engine == "postgres":
+		d.nodeID = uuid.New().String()
+		go d.listen(config.Connection)
+	case config.PollInterval > 0:
+		go d.poll(config.PollInterval)
+	}
+	if d.txtMaxAge > 0 {
+		interval := config.JanitorInterval
+		if interval <= 0 {
+			interval = defaultJanitorInterval
+		}
+		go d.runJanitor(interval)
+	}
 	return d, nil
 }
 
+// initSerial creates the zone serial if it does not exist yet. It is seeded from
+// the current time, which is how the serial was generated before it was persisted.
+// The check and the insert are a single statement, so that nodes starting at the
+// same time don't both create it. PostgreSQL could still run two of them side by
+// side, which a lock held until the end of the transaction prevents.
+func (d *acmedb) initSerial() error {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	if d.engine == "postgres" {
+		if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", serialLockID); err != nil {
+			return err
+		}
+	}
+	insserial := fmt.Sprintf(`
+	INSERT INTO acmedns (Name, Value) SELECT 'serial', '%s'
+	WHERE NOT EXISTS (SELECT 1 FROM acmedns WHERE Name='serial')`, time.Now().Format("2006010215"))
+	_, err = tx.Exec(insserial)
+	return err
+}
+
+// runJanitor periodically blanks expired TXT values until the database is closed
+func (d *acmedb) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			n, err := d.ExpireTXT()
+			if err != nil {
+				d.logger.Error("While expiring TXT values", zap.Error(err))
+			} else if n > 0 {
+				d.logger.Info("Expired stale TXT values", zap.Int64("count", n))
+			}
+		}
+	}
+}
+
+// txtCutoff returns the Unix time before which TXT values are considered expired
+func (d *acmedb) txtCutoff() int64 {
+	if d.txtMaxAge <= 0 {
+		return 0
+	}
+	return time.Now().Add(-d.txtMaxAge).Unix()
+}
+
 func (d *acmedb) checkDBUpgrades(versionString string) error {
 	var err error
 	version, err := strconv.Atoi(versionString)
@@ -105,8 +195,20 @@ func (d *acmedb) checkDBUpgrades(versionString string) error {
 }
 
 func (d *acmedb) handleDBUpgrades(version int) error {
-	if version == 0 {
-		return d.handleDBUpgradeTo1()
+	if version < 1 {
+		if err := d.handleDBUpgradeTo1(); err != nil {
+			return err
+		}
+	}
+	if version < 2 {
+		if err := d.handleDBUpgradeTo2(); err != nil {
+			return err
+		}
+	}
+	if version < 3 {
+		if err := d.handleDBUpgradeTo3(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -163,6 +265,58 @@ func (d *acmedb) handleDBUpgradeTo1() error {
 	return err
 }
 
+// handleDBUpgradeTo2 adds the zone to accounts. Existing accounts keep an empty
+// zone, which stands for the default zone.
+func (d *acmedb) handleDBUpgradeTo2() error {
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		d.logger.Error("In DB upgrade", zap.Error(err))
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	_, err = tx.Exec("ALTER TABLE records ADD COLUMN Zone TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		d.logger.Error("In DB upgrade while adding zone column", zap.Error(err))
+		return err
+	}
+	_, err = tx.Exec("UPDATE acmedns SET Value='2' WHERE Name='db_version'")
+	return err
+}
+
+// handleDBUpgradeTo3 adds the TSIG secret to accounts. Existing accounts get no
+// secret and can only be updated through the HTTP API.
+func (d *acmedb) handleDBUpgradeTo3() error {
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		d.logger.Error("In DB upgrade", zap.Error(err))
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	_, err = tx.Exec("ALTER TABLE records ADD COLUMN TSIGSecret TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		d.logger.Error("In DB upgrade while adding TSIG secret column", zap.Error(err))
+		return err
+	}
+	_, err = tx.Exec("UPDATE acmedns SET Value='3' WHERE Name='db_version'")
+	return err
+}
+
 // Create two rows for subdomain to the txt table
 func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string) error {
 	var err error
@@ -172,7 +326,18 @@ func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string) error {
 	return err
 }
 
-func (d *acmedb) Register(afrom model.CIDRSlice) (*model.ACMETxt, error) {
+// Register creates a new account in the zone. An empty zone stands for the default zone.
+func (d *acmedb) Register(afrom model.CIDRSlice, zone string) (*model.ACMETxt, error) {
+	a, err := d.register(afrom, zone)
+	if err != nil {
+		return nil, err
+	}
+	// Other nodes may have cached the subdomain as unknown
+	d.changed(a.Subdomain)
+	return a, nil
+}
+
+func (d *acmedb) register(afrom model.CIDRSlice, zone string) (*model.ACMETxt, error) {
 	d.Lock()
 	defer d.Unlock()
 	var err error
@@ -192,14 +357,17 @@ func (d *acmedb) Register(afrom model.CIDRSlice) (*model.ACMETxt, error) {
 	}
 
 	a.AllowFrom = afrom
+	a.Zone = zone
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(a.Password), 10)
 	regSQL := `
     INSERT INTO records(
         Username,
         Password,
         Subdomain,
-		AllowFrom) 
-        values($1, $2, $3, $4)`
+		AllowFrom,
+		Zone,
+		TSIGSecret)
+        values($1, $2, $3, $4, $5, $6)`
 	if d.engine == "sqlite3" {
 		regSQL = getSQLiteStmt(regSQL)
 	}
@@ -215,7 +383,7 @@ func (d *acmedb) Register(afrom model.CIDRSlice) (*model.ACMETxt, error) {
 		return nil, err
 	}
 
-	if _, err = sm.Exec(a.Username.String(), passwordHash, a.Subdomain, afromJSON); err != nil {
+	if _, err = sm.Exec(a.Username.String(), passwordHash, a.Subdomain, afromJSON, a.Zone, a.TSIGSecret); err != nil {
 		return nil, err
 	}
 
@@ -231,7 +399,7 @@ func (d *acmedb) GetByUsername(u uuid.UUID) (*model.ACMETxt, error) {
 	defer d.Unlock()
 	var results []model.ACMETxt
 	getSQL := `
-	SELECT Username, Password, Subdomain, AllowFrom
+	SELECT Username, Password, Subdomain, AllowFrom, Zone, TSIGSecret
 	FROM records
 	WHERE Username=$1 LIMIT 1
 	`
@@ -264,13 +432,73 @@ func (d *acmedb) GetByUsername(u uuid.UUID) (*model.ACMETxt, error) {
 	return nil, errors.New("no user")
 }
 
+// SubdomainExists checks if an account has been registered for the subdomain
+func (d *acmedb) SubdomainExists(subdomain string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	subdomain = model.SanitizeString(subdomain)
+	getSQL := `
+	SELECT COUNT(*) FROM records WHERE Subdomain=$1
+	`
+	if d.engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+
+	var count int
+	if err := d.DB.QueryRow(getSQL, subdomain).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// GetTXTForDomain returns the TXT values of a subdomain, from the cache if enabled
 func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
+	account, err := d.lookupAccount(domain)
+	if err != nil {
+		return nil, err
+	}
+	return account.values, nil
+}
+
+// GetAccountZone returns the zone the account of a subdomain was registered in, and
+// whether the account exists. The zone is empty for old accounts of the default
+// zone. Served from the cache if enabled.
+func (d *acmedb) GetAccountZone(subdomain string) (string, bool, error) {
+	account, err := d.lookupAccount(subdomain)
+	if err != nil {
+		return "", false, err
+	}
+	return account.zone, account.exists, nil
+}
+
+func (d *acmedb) lookupAccount(subdomain string) (*txtCacheEntry, error) {
+	subdomain = model.SanitizeString(subdomain)
+	if d.cache == nil {
+		return d.readAccount(subdomain)
+	}
+	account, generation, ok := d.cache.get(subdomain)
+	if ok {
+		return account, nil
+	}
+	account, err := d.readAccount(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(account, generation)
+	return account, nil
+}
+
+// readAccount reads the zone and TXT values of a subdomain from the database, along
+// with the time the first of the values expires. The time is zero if values don't
+// expire.
+func (d *acmedb) readAccount(subdomain string) (*txtCacheEntry, error) {
 	d.Lock()
 	defer d.Unlock()
-	domain = model.SanitizeString(domain)
-	var txts []string
+	account := &txtCacheEntry{subdomain: subdomain}
 	getSQL := `
-	SELECT Value FROM txt WHERE Subdomain=$1 LIMIT 2
+	SELECT records.Zone, txt.Value, txt.LastUpdate
+	FROM records LEFT JOIN txt ON txt.Subdomain=records.Subdomain AND txt.LastUpdate>=$1
+	WHERE records.Subdomain=$2 LIMIT 2
 	`
 	if d.engine == "sqlite3" {
 		getSQL = getSQLiteStmt(getSQL)
@@ -278,33 +506,68 @@ func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
 
 	sm, err := d.DB.Prepare(getSQL)
 	if err != nil {
-		return txts, err
+		return nil, err
 	}
 	defer sm.Close()
-	rows, err := sm.Query(domain)
+	rows, err := sm.Query(d.txtCutoff(), subdomain)
 	if err != nil {
-		return txts, err
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var rtxt string
-		err = rows.Scan(&rtxt)
+		var rtxt sql.NullString
+		var lastUpdate sql.NullInt64
+		err = rows.Scan(&account.zone, &rtxt, &lastUpdate)
 		if err != nil {
-			return txts, err
+			return nil, err
+		}
+		account.exists = true
+		if !rtxt.Valid {
+			continue
+		}
+		account.values = append(account.values, rtxt.String)
+		if d.txtMaxAge > 0 && rtxt.String != "" {
+			if e := time.Unix(lastUpdate.Int64, 0).Add(d.txtMaxAge); account.expires.IsZero() || e.Before(account.expires) {
+				account.expires = e
+			}
 		}
-		txts = append(txts, rtxt)
 	}
-	return txts, nil
+	return account, nil
 }
 
 func (d *acmedb) Update(a *model.ACMETxtPost) error {
+	updated, err := d.update(a)
+	if err != nil {
+		return err
+	}
+	if updated {
+		d.changed(a.Subdomain)
+	}
+	return nil
+}
+
+// update stores a TXT value and reports whether the account had a row to update
+func (d *acmedb) update(a *model.ACMETxtPost) (bool, error) {
 	d.Lock()
 	defer d.Unlock()
 	var err error
 	// Data in a is already sanitized
 	timenow := time.Now().Unix()
 
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+
 	updSQL := `
 	UPDATE txt SET Value=$1, LastUpdate=$2
 	WHERE rowid=(
@@ -314,18 +577,212 @@ func (d *acmedb) Update(a *model.ACMETxtPost) error {
 		updSQL = getSQLiteStmt(updSQL)
 	}
 
-	sm, err := d.DB.Prepare(updSQL)
+	sm, err := tx.Prepare(updSQL)
+	if err != nil {
+		return false, err
+	}
+	defer sm.Close()
+	res, err := sm.Exec(a.Value, timenow, a.Subdomain)
+	if err != nil {
+		return false, err
+	}
+	// The zone didn't change if the account doesn't exist
+	var rows int64
+	rows, err = res.RowsAffected()
+	if err != nil || rows == 0 {
+		return false, err
+	}
+	_, err = tx.Exec(serialBumpSQL)
+	return err == nil, err
+}
+
+// ClearTXT blanks the TXT values of the subdomain matching value, or all of them
+// if value is empty. Blank values are not served.
+func (d *acmedb) ClearTXT(subdomain string, value string) error {
+	cleared, err := d.clearTXT(subdomain, value)
 	if err != nil {
 		return err
 	}
+	if cleared {
+		d.changed(subdomain)
+	}
+	return nil
+}
+
+// clearTXT blanks matching TXT values and reports whether any were cleared
+func (d *acmedb) clearTXT(subdomain string, value string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	// Cleared rows get the oldest LastUpdate so that update() reuses them first
+	clrSQL := `
+	UPDATE txt SET Value='', LastUpdate=0
+	WHERE Subdomain=$1 AND Value<>'' AND ($2='' OR Value=$3)
+	`
+	if d.engine == "sqlite3" {
+		clrSQL = getSQLiteStmt(clrSQL)
+	}
+
+	sm, err := tx.Prepare(clrSQL)
+	if err != nil {
+		return false, err
+	}
 	defer sm.Close()
-	_, err = sm.Exec(a.Value, timenow, a.Subdomain)
+	res, err := sm.Exec(subdomain, value, value)
+	if err != nil {
+		return false, err
+	}
+	// The zone didn't change if there was no such value
+	var rows int64
+	rows, err = res.RowsAffected()
+	if err != nil || rows == 0 {
+		return false, err
+	}
+	_, err = tx.Exec(serialBumpSQL)
+	return err == nil, err
+}
+
+// GetSerial returns the current zone serial
+func (d *acmedb) GetSerial() (uint32, error) {
+	d.Lock()
+	defer d.Unlock()
+	var serial string
+	err := d.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='serial'").Scan(&serial)
+	if err != nil {
+		return 0, err
+	}
+	s, err := strconv.ParseUint(serial, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(s), nil
+}
+
+// BumpSerial increments the zone serial, eg. after the static records were reloaded
+func (d *acmedb) BumpSerial() error {
+	d.Lock()
+	_, err := d.DB.Exec(serialBumpSQL)
+	d.Unlock()
 	if err != nil {
 		return err
 	}
+	d.changed("")
 	return nil
 }
 
+// Subscribe registers a function that is called after TXT values or the zone
+// serial changed, also when the change was made by another node sharing the
+// database. The subdomain is empty if the change is not limited to a single
+// account. The function is called synchronously and must not block.
+func (d *acmedb) Subscribe(f func(subdomain string)) {
+	d.subscribersMu.Lock()
+	defer d.subscribersMu.Unlock()
+	d.subscribers = append(d.subscribers, f)
+}
+
+// changed tells the other nodes and the subscribers about a change made by this node
+func (d *acmedb) changed(subdomain string) {
+	d.publish(subdomain)
+	d.notifySubscribers(subdomain)
+}
+
+func (d *acmedb) notifySubscribers(subdomain string) {
+	if d.cache != nil {
+		d.cache.invalidate(subdomain)
+	}
+	d.subscribersMu.Lock()
+	subscribers := d.subscribers
+	d.subscribersMu.Unlock()
+	for _, f := range subscribers {
+		f(subdomain)
+	}
+}
+
+// ListTXT returns every TXT value currently being served, along with the
+// subdomain and zone of the account it belongs to
+func (d *acmedb) ListTXT() ([]model.ACMETxt, error) {
+	d.Lock()
+	defer d.Unlock()
+	var txts []model.ACMETxt
+	getSQL := `
+	SELECT txt.Subdomain, txt.Value, records.Zone
+	FROM txt JOIN records ON txt.Subdomain=records.Subdomain
+	WHERE txt.Value<>'' AND txt.LastUpdate>=$1
+	ORDER BY txt.Subdomain
+	`
+	if d.engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+
+	rows, err := d.DB.Query(getSQL, d.txtCutoff())
+	if err != nil {
+		return txts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var txt model.ACMETxt
+		if err = rows.Scan(&txt.Subdomain, &txt.Value, &txt.Zone); err != nil {
+			return txts, err
+		}
+		txts = append(txts, txt)
+	}
+	return txts, rows.Err()
+}
+
+// ExpireTXT blanks TXT values older than the configured maximum age and returns
+// the number of values removed. It is a no-op if expiry is disabled.
+func (d *acmedb) ExpireTXT() (int64, error) {
+	n, err := d.expireTXT()
+	if n > 0 && err == nil {
+		d.changed("")
+	}
+	return n, err
+}
+
+func (d *acmedb) expireTXT() (int64, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.txtMaxAge <= 0 {
+		return 0, nil
+	}
+	expSQL := `
+	UPDATE txt SET Value=''
+	WHERE Value<>'' AND LastUpdate<$1
+	`
+	if d.engine == "sqlite3" {
+		expSQL = getSQLiteStmt(expSQL)
+	}
+
+	sm, err := d.DB.Prepare(expSQL)
+	if err != nil {
+		return 0, err
+	}
+	defer sm.Close()
+	res, err := sm.Exec(d.txtCutoff())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return n, err
+	}
+	_, err = d.DB.Exec(serialBumpSQL)
+	return n, err
+}
+
 func (d *acmedb) getModelFromRow(r *sql.Rows) (model.ACMETxt, error) {
 	txt := model.ACMETxt{}
 	afrom := ""
@@ -333,7 +790,9 @@ func (d *acmedb) getModelFromRow(r *sql.Rows) (model.ACMETxt, error) {
 		&txt.Username,
 		&txt.Password,
 		&txt.Subdomain,
-		&afrom)
+		&afrom,
+		&txt.Zone,
+		&txt.TSIGSecret)
 	if err != nil {
 		d.logger.Error("Row scan error", zap.Error(err))
 	}
@@ -348,6 +807,11 @@ func (d *acmedb) getModelFromRow(r *sql.Rows) (model.ACMETxt, error) {
 }
 
 func (d *acmedb) Close() {
+	select {
+	case <-d.done:
+	default:
+		close(d.done)
+	}
 	d.DB.Close()
 }
 
@@ -357,6 +821,9 @@ func (d *acmedb) GetBackend() *sql.DB {
 
 func (d *acmedb) SetBackend(backend *sql.DB) {
 	d.DB = backend
+	if d.cache != nil {
+		d.cache.invalidate("")
+	}
 }
 
 func CorrectPassword(pw string, hash string) bool {
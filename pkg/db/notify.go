@@ -0,0 +1,125 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// notifyChannel is the PostgreSQL channel nodes sharing a database announce their
+// changes on
+const notifyChannel = "dnsacmed_changes"
+
+// Reconnection policy of the PostgreSQL listener
+const (
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+	listenerPingInterval = 90 * time.Second
+)
+
+// publish announces a change to the other nodes sharing a PostgreSQL database. The
+// payload is the node ID followed by the subdomain.
+func (d *acmedb) publish(subdomain string) {
+	if d.nodeID == "" {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if _, err := d.DB.Exec("SELECT pg_notify($1, $2)", notifyChannel, d.nodeID+" "+subdomain); err != nil {
+		d.logger.Warn("Could not announce change to other nodes", zap.Error(err))
+	}
+}
+
+// listen passes the changes announced by other nodes on to the subscribers until
+// the database is closed
+func (d *acmedb) listen(connection string) {
+	l := pq.NewListener(connection, listenerMinReconnect, listenerMaxReconnect, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			d.logger.Warn("PostgreSQL listener connection problem", zap.Error(err))
+		}
+	})
+	defer l.Close()
+	// The listener reconnects by itself, so LISTEN only fails if the server refuses
+	// it, which may be temporary
+	missed := false
+	for wait := listenerMinReconnect; ; {
+		err := l.Listen(notifyChannel)
+		if err == nil {
+			break
+		}
+		d.logger.Warn("Could not listen for changes of other nodes, retrying", zap.Error(err), zap.Duration("retry", wait))
+		select {
+		case <-d.done:
+			return
+		case <-time.After(wait):
+		}
+		missed = true
+		if wait *= 2; wait > listenerMaxReconnect {
+			wait = listenerMaxReconnect
+		}
+	}
+	if missed {
+		// Changes may have been made while not listening
+		d.notifySubscribers("")
+	}
+	for {
+		select {
+		case <-d.done:
+			return
+		case n := <-l.Notify:
+			if n == nil {
+				// Changes may have been missed while reconnecting
+				d.notifySubscribers("")
+				continue
+			}
+			node, subdomain, _ := strings.Cut(n.Extra, " ")
+			if node != d.nodeID {
+				d.notifySubscribers(subdomain)
+			}
+		case <-time.After(listenerPingInterval):
+			go l.Ping()
+		}
+	}
+}
+
+func (d *acmedb) closed() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// poll checks the zone serial for changes made by other processes, as every change
+// increments it, until the database is closed. Changes made by this process are
+// seen again, which is harmless.
+func (d *acmedb) poll(interval time.Duration) {
+	last, err := d.GetSerial()
+	if err != nil {
+		d.logger.Warn("Could not get zone serial", zap.Error(err))
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			serial, err := d.GetSerial()
+			if err != nil {
+				if d.closed() {
+					return
+				}
+				d.logger.Warn("Could not get zone serial", zap.Error(err))
+				continue
+			}
+			if serial != last {
+				last = serial
+				d.notifySubscribers("")
+			}
+		}
+	}
+}
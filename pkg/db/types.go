@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jdpage/dnsacmed/pkg/model"
@@ -12,20 +13,50 @@ import (
 type Config struct {
 	Engine     string `json:"engine"`
 	Connection string `json:"connection"`
+	// TXTMaxAge is the age after which a TXT value is no longer served. Zero
+	// disables expiry.
+	TXTMaxAge time.Duration `json:"txt_max_age"`
+	// JanitorInterval is how often expired TXT values are blanked in the
+	// database. Only used if TXTMaxAge is set.
+	JanitorInterval time.Duration `json:"janitor_interval"`
+	// TXTCacheSize is the number of subdomains whose TXT values are cached for
+	// answering DNS queries. Zero disables the cache.
+	TXTCacheSize int `json:"txt_cache_size"`
+	// TXTCacheRefresh is how long cached TXT values are served before they are
+	// read from the database again
+	TXTCacheRefresh time.Duration `json:"txt_cache_refresh"`
+	// PollInterval is how often a sqlite3 database is checked for changes made by
+	// other processes. Zero disables polling. PostgreSQL announces changes instead.
+	PollInterval time.Duration `json:"poll_interval"`
 }
 
 type acmedb struct {
 	sync.Mutex
-	logger *zap.Logger
-	DB     *sql.DB
-	engine string
+	logger    *zap.Logger
+	DB        *sql.DB
+	engine    string
+	txtMaxAge time.Duration
+	cache     *txtCache
+	// nodeID tells apart the changes announced by this node from those of others
+	nodeID        string
+	done          chan struct{}
+	subscribersMu sync.Mutex
+	subscribers   []func(string)
 }
 
 type Database interface {
-	Register(model.CIDRSlice) (*model.ACMETxt, error)
+	Register(model.CIDRSlice, string) (*model.ACMETxt, error)
 	GetByUsername(uuid.UUID) (*model.ACMETxt, error)
 	GetTXTForDomain(string) ([]string, error)
+	GetAccountZone(string) (string, bool, error)
+	SubdomainExists(string) (bool, error)
 	Update(*model.ACMETxtPost) error
+	ClearTXT(string, string) error
+	ExpireTXT() (int64, error)
+	GetSerial() (uint32, error)
+	BumpSerial() error
+	ListTXT() ([]model.ACMETxt, error)
+	Subscribe(func(string))
 	GetBackend() *sql.DB
 	SetBackend(*sql.DB)
 	Close()
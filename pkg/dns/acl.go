@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// queryACLRefused counts the requests refused or dropped by the query ACL, published
+// with expvar
+var queryACLRefused = expvar.NewInt("dns_query_acl_refused")
+
+// acl allows the networks in allow, unless they are also in deny. An empty allow
+// list allows everybody not denied.
+type acl struct {
+	allow model.CIDRSlice
+	deny  model.CIDRSlice
+}
+
+func parseACL(prefix string, c ACLConfig) (acl, error) {
+	allow, err := model.ParseCIDRSlice(c.AllowFrom)
+	if err != nil {
+		return acl{}, fmt.Errorf("Option %sallow_from: %w", prefix, err)
+	}
+	deny, err := model.ParseCIDRSlice(c.DenyFrom)
+	if err != nil {
+		return acl{}, fmt.Errorf("Option %sdeny_from: %w", prefix, err)
+	}
+	return acl{allow: allow, deny: deny}, nil
+}
+
+func (a acl) allows(ip net.IP) bool {
+	if len(a.deny) > 0 && a.deny.Contains(ip) {
+		return false
+	}
+	return a.allow.Contains(ip)
+}
+
+// queryACL restricts which clients may send requests to the server. A request has to
+// be allowed by both the lists for all requests and those of its transport.
+type queryACL struct {
+	all  acl
+	udp  acl
+	tcp  acl
+	drop bool
+}
+
+// ConfigureQueryACL sets up the networks allowed to query the server. Zone transfers
+// are controlled by the transfer options instead.
+func (d *DNSServer) ConfigureQueryACL(config *Config) error {
+	c := config.QueryACL
+	if len(c.AllowFrom)+len(c.DenyFrom)+len(c.UDP.AllowFrom)+len(c.UDP.DenyFrom)+len(c.TCP.AllowFrom)+len(c.TCP.DenyFrom) == 0 {
+		d.queryACL = nil
+		return nil
+	}
+	all, err := parseACL("dns.query_acl.", ACLConfig{AllowFrom: c.AllowFrom, DenyFrom: c.DenyFrom})
+	if err != nil {
+		return err
+	}
+	udp, err := parseACL("dns.query_acl.udp.", c.UDP)
+	if err != nil {
+		return err
+	}
+	tcp, err := parseACL("dns.query_acl.tcp.", c.TCP)
+	if err != nil {
+		return err
+	}
+	d.queryACL = &queryACL{all: all, udp: udp, tcp: tcp, drop: c.Drop}
+	return nil
+}
+
+// allows checks if a request may be answered. Requests over TCP, DNS-over-TLS and
+// DNS-over-HTTPS are checked against the TCP lists.
+func (a *queryACL) allows(addr net.Addr) bool {
+	ip, _ := remoteIP(addr)
+	transport := a.tcp
+	if _, ok := addr.(*net.UDPAddr); ok {
+		transport = a.udp
+	}
+	return a.all.allows(ip) && transport.allows(ip)
+}
+
+// refuseQuery answers a request from a client that is not allowed to query the
+// server with REFUSED, or not at all if so configured. It returns false if the
+// request may be answered.
+func (d *DNSServer) refuseQuery(w dns.ResponseWriter, r *dns.Msg) bool {
+	if d.queryACL == nil || d.queryACL.allows(w.RemoteAddr()) {
+		return false
+	}
+	queryACLRefused.Add(1)
+	d.logger.Debug("Refusing query from client not allowed by the query ACL", zap.String("client", w.RemoteAddr().String()))
+	if d.queryACL.drop {
+		return true
+	}
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	_ = w.WriteMsg(m)
+	return true
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestQueryACLAllows(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 53}
+	tcp := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 53}
+	outside := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	for _, test := range []struct {
+		name    string
+		acl     QueryACLConfig
+		addr    net.Addr
+		allowed bool
+	}{
+		{"allowed", QueryACLConfig{AllowFrom: []string{"10.0.0.0/8"}}, udp, true},
+		{"not allowed", QueryACLConfig{AllowFrom: []string{"10.0.0.0/8"}}, outside, false},
+		{"denied", QueryACLConfig{AllowFrom: []string{"10.0.0.0/8"}, DenyFrom: []string{"10.1.0.0/16"}}, udp, false},
+		{"deny only", QueryACLConfig{DenyFrom: []string{"10.1.0.0/16"}}, outside, true},
+		{"udp only", QueryACLConfig{UDP: ACLConfig{AllowFrom: []string{"10.0.0.0/8"}}}, tcp, true},
+		{"udp denied", QueryACLConfig{UDP: ACLConfig{DenyFrom: []string{"10.0.0.0/8"}}}, udp, false},
+		{"tcp denied", QueryACLConfig{TCP: ACLConfig{DenyFrom: []string{"10.0.0.0/8"}}}, tcp, false},
+		{"both lists", QueryACLConfig{AllowFrom: []string{"192.0.2.0/24"}, TCP: ACLConfig{AllowFrom: []string{"10.0.0.0/8"}}}, tcp, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := setupConfig()
+			config.QueryACL = test.acl
+			dnsServer := NewDNSServer(zaptest.NewLogger(t), nil, config.Listen, config.Proto, config.Domain)
+			if err := dnsServer.ConfigureQueryACL(&config); err != nil {
+				t.Fatalf("Could not configure query ACL: [%v]", err)
+			}
+			if allowed := dnsServer.queryACL.allows(test.addr); allowed != test.allowed {
+				t.Errorf("Expected allowed to be %t, but got %t", test.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestQueryACLServer(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		acl  QueryACLConfig
+	}{
+		{"refused", QueryACLConfig{AllowFrom: []string{"10.0.0.0/8"}}},
+		{"dropped", QueryACLConfig{DenyFrom: []string{"127.0.0.1/32"}, Drop: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := setupConfig()
+			config.QueryACL = test.acl
+			_, stop := setupConfiguredDNSServer(t, config, zaptest.NewLogger(t), nil)
+			defer stop()
+
+			refused := queryACLRefused.Value()
+			m := new(dns.Msg)
+			m.SetQuestion("auth.example.org.", dns.TypeA)
+			in, err := dns.Exchange(m, "127.0.0.1:15353")
+			if test.acl.Drop {
+				if err == nil {
+					t.Errorf("Expected query to be dropped, but got %v", in)
+				}
+			} else if err != nil || in.Rcode != dns.RcodeRefused || len(in.Answer) != 0 {
+				t.Errorf("Expected query to be refused, but got %v [%v]", in, err)
+			}
+			if queryACLRefused.Value()-refused != 1 {
+				t.Errorf("Expected the refused query to be counted")
+			}
+		})
+	}
+}
+
+func TestConfigureQueryACLErrors(t *testing.T) {
+	for _, acl := range []QueryACLConfig{
+		{AllowFrom: []string{"not a network"}},
+		{DenyFrom: []string{"10.0.0.0/33"}},
+		{UDP: ACLConfig{AllowFrom: []string{"nope"}}},
+		{TCP: ACLConfig{DenyFrom: []string{"nope"}}},
+	} {
+		config := setupConfig()
+		config.QueryACL = acl
+		dnsServer := NewDNSServer(zaptest.NewLogger(t), nil, config.Listen, config.Proto, config.Domain)
+		if err := dnsServer.ConfigureQueryACL(&config); err == nil {
+			t.Errorf("Expected error for %+v", acl)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Defaults for the TTL and SOA timer options, used when an option is unset
+const (
+	DefaultTXTTTL     uint32 = 1
+	DefaultSOATTL     uint32 = 3600
+	DefaultSOARefresh uint32 = 28800
+	DefaultSOARetry   uint32 = 7200
+	DefaultSOAExpire  uint32 = 604800
+	DefaultSOAMinimum uint32 = 86400
+)
+
+// DefaultMaxUDPSize is the largest UDP answer sent unless configured otherwise. It
+// avoids IP fragmentation on common links (DNS flag day 2020).
+const DefaultMaxUDPSize uint16 = 1232
+
+// maxTTL is the largest TTL value allowed by RFC 2181
+const maxTTL uint32 = 1<<31 - 1
+
+// SetDefaults fills in unset TTL and SOA timer options with their defaults
+func (c *Config) SetDefaults() {
+	for _, v := range []struct {
+		opt *uint32
+		def uint32
+	}{
+		{&c.TXTTTL, DefaultTXTTTL},
+		{&c.SOATTL, DefaultSOATTL},
+		{&c.SOARefresh, DefaultSOARefresh},
+		{&c.SOARetry, DefaultSOARetry},
+		{&c.SOAExpire, DefaultSOAExpire},
+		{&c.SOAMinimum, DefaultSOAMinimum},
+	} {
+		if *v.opt == 0 {
+			*v.opt = v.def
+		}
+	}
+	if c.MaxUDPSize == 0 {
+		c.MaxUDPSize = DefaultMaxUDPSize
+	}
+	for i := range c.Zones {
+		z := &c.Zones[i]
+		for _, v := range []struct {
+			opt *uint32
+			def uint32
+		}{
+			{&z.SOATTL, c.SOATTL},
+			{&z.SOARefresh, c.SOARefresh},
+			{&z.SOARetry, c.SOARetry},
+			{&z.SOAExpire, c.SOAExpire},
+			{&z.SOAMinimum, c.SOAMinimum},
+		} {
+			if *v.opt == 0 {
+				*v.opt = v.def
+			}
+		}
+	}
+}
+
+// AllZones returns the default zone followed by the additional zones
+func (c *Config) AllZones() []ZoneConfig {
+	zones := []ZoneConfig{{
+		Domain:        c.Domain,
+		NSName:        c.NSName,
+		NSAdmin:       c.NSAdmin,
+		StaticRecords: c.StaticRecords,
+		ZoneFile:      c.ZoneFile,
+		SOATTL:        c.SOATTL,
+		SOARefresh:    c.SOARefresh,
+		SOARetry:      c.SOARetry,
+		SOAExpire:     c.SOAExpire,
+		SOAMinimum:    c.SOAMinimum,
+		DNSSECKeys:    c.DNSSECKeys,
+	}}
+	return append(zones, c.Zones...)
+}
+
+// HasZone checks if the domain is one of the configured zones
+func (c *Config) HasZone(domain string) bool {
+	domain = NormalizeZone(domain)
+	for _, z := range c.AllZones() {
+		if NormalizeZone(z.Domain) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the TTL, SOA timer and zone options are sensible. It should
+// be called after SetDefaults.
+func (c *Config) Validate() error {
+	if c.TXTTTL == 0 || c.TXTTTL > maxTTL {
+		return fmt.Errorf("Option dns.txt_ttl must be between 1 and %d", maxTTL)
+	}
+	if c.MaxUDPSize < dns.MinMsgSize {
+		return fmt.Errorf("Option dns.max_udp_size must be at least %d", dns.MinMsgSize)
+	}
+	if c.Dnstap.Socket != "" && c.Dnstap.File != "" {
+		return fmt.Errorf("Options dns.dnstap.socket and dns.dnstap.file are mutually exclusive")
+	}
+	if c.Dnstap.Sample < 0 {
+		return fmt.Errorf("Option dns.dnstap.sample must not be negative")
+	}
+	seen := make(map[string]bool)
+	for i, z := range c.AllZones() {
+		prefix := "dns."
+		if i > 0 {
+			prefix = fmt.Sprintf("dns.zones[%d].", i-1)
+		}
+		if z.Domain == "" || z.NSName == "" || z.NSAdmin == "" {
+			return fmt.Errorf("Options %sdomain, %snsname and %snsadmin are required", prefix, prefix, prefix)
+		}
+		if seen[NormalizeZone(z.Domain)] {
+			return fmt.Errorf("Zone %s is configured more than once", z.Domain)
+		}
+		seen[NormalizeZone(z.Domain)] = true
+		if err := z.validateTimers(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *ZoneConfig) validateTimers(prefix string) error {
+	for _, v := range []struct {
+		name string
+		val  uint32
+	}{
+		{"soa_ttl", z.SOATTL},
+		{"soa_refresh", z.SOARefresh},
+		{"soa_retry", z.SOARetry},
+		{"soa_expire", z.SOAExpire},
+		{"soa_minimum", z.SOAMinimum},
+	} {
+		if v.val == 0 || v.val > maxTTL {
+			return fmt.Errorf("Option %s%s must be between 1 and %d", prefix, v.name, maxTTL)
+		}
+	}
+	if z.SOARetry >= z.SOARefresh {
+		return fmt.Errorf("Option %ssoa_retry must be smaller than %ssoa_refresh", prefix, prefix)
+	}
+	if z.SOAExpire <= z.SOARefresh+z.SOARetry {
+		return fmt.Errorf("Option %ssoa_expire must be larger than %ssoa_refresh plus %ssoa_retry", prefix, prefix, prefix)
+	}
+	return nil
+}
+
+// NormalizeZone returns the zone name in lower case without a trailing dot, the
+// form used in the API and the database
+func NormalizeZone(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
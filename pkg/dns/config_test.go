@@ -0,0 +1,67 @@
+package dns
+
+import (
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	base := func(c Config) Config {
+		c.Domain = "auth.example.org"
+		c.NSName = "ns1.auth.example.org"
+		c.NSAdmin = "admin.example.org"
+		return c
+	}
+	zone := ZoneConfig{Domain: "acme.eu.example.com", NSName: "ns1.acme.eu.example.com", NSAdmin: "admin.example.com"}
+	for _, test := range []struct {
+		name   string
+		config Config
+		valid  bool
+	}{
+		{"defaults", base(Config{}), true},
+		{"custom", base(Config{TXTTTL: 60, SOATTL: 300, SOARefresh: 3600, SOARetry: 600, SOAExpire: 86400, SOAMinimum: 60}), true},
+		{"retry not below refresh", base(Config{SOARefresh: 600, SOARetry: 600}), false},
+		{"expire too small", base(Config{SOARefresh: 3600, SOARetry: 600, SOAExpire: 4000}), false},
+		{"ttl too large", base(Config{TXTTTL: 1 << 31}), false},
+		{"udp size too small", base(Config{MaxUDPSize: 511}), false},
+		{"dnstap socket and file", base(Config{Dnstap: DnstapConfig{Socket: "/run/dnstap.sock", File: "/var/log/dnstap"}}), false},
+		{"dnstap negative sample", base(Config{Dnstap: DnstapConfig{Socket: "/run/dnstap.sock", Sample: -1}}), false},
+		{"missing domain", Config{NSName: "ns1.auth.example.org", NSAdmin: "admin.example.org"}, false},
+		{"zones", base(Config{Zones: []ZoneConfig{zone}}), true},
+		{"zone without nsname", base(Config{Zones: []ZoneConfig{{Domain: "acme.eu.example.com", NSAdmin: "admin.example.com"}}}), false},
+		{"duplicate zone", base(Config{Zones: []ZoneConfig{zone, zone}}), false},
+		{"zone shadowing default", base(Config{Zones: []ZoneConfig{{Domain: "Auth.Example.org.", NSName: "ns", NSAdmin: "admin"}}}), false},
+		{"zone timers", base(Config{Zones: []ZoneConfig{{Domain: "acme.eu.example.com", NSName: "ns", NSAdmin: "admin", SOARetry: 30000}}}), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.SetDefaults()
+			err := test.config.Validate()
+			if test.valid && err != nil {
+				t.Errorf("Expected config to be valid, but got error [%v]", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("Expected config to be invalid, but got no error")
+			}
+		})
+	}
+}
+
+func TestHasZone(t *testing.T) {
+	config := Config{
+		Domain: "auth.example.org",
+		Zones:  []ZoneConfig{{Domain: "acme.eu.example.com."}},
+	}
+	for _, test := range []struct {
+		domain string
+		output bool
+	}{
+		{"auth.example.org", true},
+		{"AUTH.example.org.", true},
+		{"acme.eu.example.com", true},
+		{"acme.us.example.com", false},
+		{"", false},
+	} {
+		if ret := config.HasZone(test.domain); ret != test.output {
+			t.Errorf("Expected HasZone(%q) to return %t, but got %t", test.domain, test.output, ret)
+		}
+	}
+}
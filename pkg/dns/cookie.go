@@ -0,0 +1,192 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Server cookies follow the layout of RFC 9018, with HMAC-SHA256 in place of SipHash
+const (
+	cookieClientLen  = 8
+	cookieServerLen  = 16
+	cookieVersion    = 1
+	cookieMaxAge     = time.Hour
+	cookieMaxFuture  = 5 * time.Minute
+	cookieSecretSize = 32
+)
+
+// cookieStatus describes the COOKIE option of a request
+type cookieStatus int
+
+const (
+	cookieNone cookieStatus = iota
+	cookieClientOnly
+	cookieValid
+	cookieMalformed
+)
+
+// cookieJar creates and checks server cookies. New cookies are created with the
+// current secret, while cookies created with the previous secret are still accepted
+// until they expire, so that the secret can be rotated without clients noticing.
+type cookieJar struct {
+	sync.RWMutex
+	secret             []byte
+	previous           []byte
+	requireWhenLimited bool
+	now                func() time.Time
+}
+
+// ConfigureCookies sets up DNS cookies (RFC 7873). If no secret is configured, one
+// is generated and stored in the config, so that all servers configured from it
+// accept each other's cookies.
+func (d *DNSServer) ConfigureCookies(config *Config) error {
+	if !config.Cookies.Enabled {
+		d.cookies = nil
+		return nil
+	}
+	jar := &cookieJar{requireWhenLimited: config.Cookies.RequireWhenLimited, now: time.Now}
+	if err := jar.setSecrets(config); err != nil {
+		return err
+	}
+	d.cookies = jar
+	return nil
+}
+
+// RotateCookieSecret switches to the cookie secret of a reloaded config, or to a new
+// random secret if none is configured. Cookies created with the secret replaced stay
+// valid, unless the config names another previous secret. Cookies can't be enabled
+// or disabled this way.
+func (d *DNSServer) RotateCookieSecret(config *Config) error {
+	if d.cookies == nil || !config.Cookies.Enabled {
+		return nil
+	}
+	return d.cookies.setSecrets(config)
+}
+
+// setSecrets takes the current and previous secret from the config, generating the
+// current one if unset. If no previous secret is configured, the current secret
+// becomes the previous one when it is replaced. Both are stored in the config, so
+// that all servers configured from it end up with the same secrets.
+func (j *cookieJar) setSecrets(config *Config) error {
+	if config.Cookies.Secret == "" {
+		secret := make([]byte, cookieSecretSize)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		config.Cookies.Secret = base64.StdEncoding.EncodeToString(secret)
+	}
+	secret, err := base64.StdEncoding.DecodeString(config.Cookies.Secret)
+	if err != nil || len(secret) < 16 {
+		return fmt.Errorf("Option dns.cookies.secret must be at least 16 base64 encoded bytes")
+	}
+	j.Lock()
+	defer j.Unlock()
+	previous := j.previous
+	if config.Cookies.PreviousSecret != "" {
+		previous, err = base64.StdEncoding.DecodeString(config.Cookies.PreviousSecret)
+		if err != nil || len(previous) < 16 {
+			return fmt.Errorf("Option dns.cookies.previous_secret must be at least 16 base64 encoded bytes")
+		}
+	} else if j.secret != nil && !hmac.Equal(j.secret, secret) {
+		previous = j.secret
+		config.Cookies.PreviousSecret = base64.StdEncoding.EncodeToString(previous)
+	}
+	j.secret, j.previous = secret, previous
+	return nil
+}
+
+// readCookie returns the client cookie of a request and whether it carries a valid
+// server cookie
+func (j *cookieJar) readCookie(opt *dns.OPT, ip net.IP) ([]byte, cookieStatus) {
+	var option *dns.EDNS0_COOKIE
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			option = c
+			break
+		}
+	}
+	if option == nil {
+		return nil, cookieNone
+	}
+	cookie, err := hex.DecodeString(option.Cookie)
+	// Server cookies are between 8 and 32 bytes long (RFC 7873 section 4)
+	if err != nil || len(cookie) != cookieClientLen && (len(cookie) < cookieClientLen+8 || len(cookie) > cookieClientLen+32) {
+		return nil, cookieMalformed
+	}
+	client := cookie[:cookieClientLen]
+	if len(cookie) == cookieClientLen || !j.valid(client, cookie[cookieClientLen:], ip) {
+		return client, cookieClientOnly
+	}
+	return client, cookieValid
+}
+
+// valid checks a server cookie received from a client
+func (j *cookieJar) valid(client []byte, server []byte, ip net.IP) bool {
+	if len(server) != cookieServerLen || server[0] != cookieVersion {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	now := j.now()
+	if issued.Before(now.Add(-cookieMaxAge)) || issued.After(now.Add(cookieMaxFuture)) {
+		return false
+	}
+	j.RLock()
+	defer j.RUnlock()
+	if hmac.Equal(server, serverCookie(j.secret, client, ip, issued)) {
+		return true
+	}
+	return j.previous != nil && hmac.Equal(server, serverCookie(j.previous, client, ip, issued))
+}
+
+// serverCookie returns the server cookie for a client issued at the given time
+func serverCookie(secret []byte, client []byte, ip net.IP, issued time.Time) []byte {
+	server := make([]byte, 8, cookieServerLen)
+	server[0] = cookieVersion
+	binary.BigEndian.PutUint32(server[4:8], uint32(issued.Unix()))
+	h := hmac.New(sha256.New, secret)
+	h.Write(client)
+	h.Write(server)
+	if ip4 := ip.To4(); ip4 != nil {
+		h.Write(ip4)
+	} else {
+		h.Write(ip.To16())
+	}
+	return append(server, h.Sum(nil)[:cookieServerLen-8]...)
+}
+
+// addCookie adds the client cookie and a fresh server cookie to a reply
+func (j *cookieJar) addCookie(m *dns.Msg, client []byte, ip net.IP) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	j.RLock()
+	server := serverCookie(j.secret, client, ip, j.now())
+	j.RUnlock()
+	cookie := append(append([]byte{}, client...), server...)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+}
+
+// badCookie returns an empty BADCOOKIE reply, which gives the client a server
+// cookie to retry with
+func badCookie(m *dns.Msg) *dns.Msg {
+	b := new(dns.Msg)
+	b.MsgHdr = m.MsgHdr
+	b.Rcode = dns.RcodeBadCookie
+	b.Authoritative = false
+	b.Question = m.Question
+	if opt := m.IsEdns0(); opt != nil {
+		b.Extra = []dns.RR{opt}
+	}
+	return b
+}
@@ -0,0 +1,228 @@
+package dns
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+func cookieOpt(cookie string) *dns.OPT {
+	opt := new(dns.OPT)
+	opt.Hdr = dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return opt
+}
+
+func TestCookieJar(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	jar := &cookieJar{secret: []byte("0123456789abcdef"), now: func() time.Time { return now }}
+	client := []byte("clientck")
+	ip := net.ParseIP("192.0.2.1")
+	server := serverCookie(jar.secret, client, ip, now)
+
+	for _, test := range []struct {
+		name   string
+		client []byte
+		ip     string
+		later  time.Duration
+		valid  bool
+	}{
+		{"same client", client, "192.0.2.1", 0, true},
+		{"almost expired", client, "192.0.2.1", 59 * time.Minute, true},
+		{"other address", client, "192.0.2.2", 0, false},
+		{"other client cookie", []byte("otherclt"), "192.0.2.1", 0, false},
+		{"expired", client, "192.0.2.1", 61 * time.Minute, false},
+		{"from the future", client, "192.0.2.1", -6 * time.Minute, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			now = time.Unix(1600000000, 0).Add(test.later)
+			if ret := jar.valid(test.client, server, net.ParseIP(test.ip)); ret != test.valid {
+				t.Errorf("Expected cookie validity %t, but got %t", test.valid, ret)
+			}
+		})
+	}
+
+	other := &cookieJar{secret: []byte("fedcba9876543210"), now: jar.now}
+	now = time.Unix(1600000000, 0)
+	if other.valid(client, server, ip) {
+		t.Errorf("Expected cookie from a server with another secret to be invalid")
+	}
+}
+
+func TestReadCookie(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	jar := &cookieJar{secret: []byte("0123456789abcdef"), now: func() time.Time { return now }}
+	ip := net.ParseIP("2001:db8::1")
+	client := []byte("clientck")
+	server := serverCookie(jar.secret, client, ip, now)
+	for _, test := range []struct {
+		name   string
+		cookie string
+		status cookieStatus
+	}{
+		{"client only", hex.EncodeToString(client), cookieClientOnly},
+		{"valid", hex.EncodeToString(append(client, server...)), cookieValid},
+		{"invalid server cookie", hex.EncodeToString(client) + strings.Repeat("00", 16), cookieClientOnly},
+		{"too short", "00112233", cookieMalformed},
+		{"server cookie too short", hex.EncodeToString(client) + "0011", cookieMalformed},
+		{"too long", strings.Repeat("00", 41), cookieMalformed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, status := jar.readCookie(cookieOpt(test.cookie), ip); status != test.status {
+				t.Errorf("Expected cookie status %d, but got %d", test.status, status)
+			}
+		})
+	}
+	if _, status := jar.readCookie(new(dns.OPT), ip); status != cookieNone {
+		t.Errorf("Expected no cookie, but got status %d", status)
+	}
+}
+
+func cookieQuery(t *testing.T, cookie string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeA)
+	m.Extra = append(m.Extra, cookieOpt(cookie))
+	in, err := dns.Exchange(m, "127.0.0.1:15353")
+	if err != nil {
+		t.Fatalf("Error querying the server [%v]", err)
+	}
+	return in
+}
+
+func replyCookie(m *dns.Msg) string {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				return c.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+func TestCookies(t *testing.T) {
+	config := setupConfig()
+	config.Cookies = CookieConfig{Enabled: true, RequireWhenLimited: true}
+	config.RateLimit = RateLimitConfig{ResponsesPerSecond: 1}
+	logger := zaptest.NewLogger(t)
+	_, stop := setupConfiguredDNSServer(t, config, logger, nil)
+	defer func() { _ = stop() }()
+
+	client := hex.EncodeToString([]byte("clientck"))
+	in := cookieQuery(t, client)
+	cookie := replyCookie(in)
+	if len(in.Answer) != 1 || !strings.HasPrefix(cookie, client) || len(cookie) != 2*(cookieClientLen+cookieServerLen) {
+		t.Fatalf("Expected answer with client and server cookie, but got %v", in)
+	}
+
+	// Over the limit without a valid server cookie
+	in = cookieQuery(t, client)
+	if in.Rcode != dns.RcodeBadCookie || len(in.Answer) != 0 || !strings.HasPrefix(replyCookie(in), client) {
+		t.Errorf("Expected BADCOOKIE with a fresh cookie, but got %v", in)
+	}
+
+	// A valid server cookie is not limited
+	in = cookieQuery(t, cookie)
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 1 {
+		t.Errorf("Expected full answer with a valid server cookie, but got %v", in)
+	}
+
+	if in = cookieQuery(t, "0011"); in.Rcode != dns.RcodeFormatError {
+		t.Errorf("Expected FORMERR for a malformed cookie, but got [%s]", dns.RcodeToString[in.Rcode])
+	}
+
+	_ = stop()
+	config.Cookies.Enabled = false
+	config.RateLimit.ResponsesPerSecond = 0
+	_, stop = setupConfiguredDNSServer(t, config, logger, nil)
+	if in = cookieQuery(t, client); replyCookie(in) != "" {
+		t.Errorf("Expected no cookie with cookies disabled, but got %v", in)
+	}
+}
+
+func TestConfigureCookiesSharedSecret(t *testing.T) {
+	config := setupConfig()
+	config.Cookies.Enabled = true
+	logger := zaptest.NewLogger(t)
+	a := NewDNSServer(logger, nil, config.Listen, "udp", config.Domain)
+	b := NewDNSServer(logger, nil, config.Listen, "tcp", config.Domain)
+	if err := a.ConfigureCookies(&config); err != nil {
+		t.Fatalf("Could not configure cookies: [%v]", err)
+	}
+	if err := b.ConfigureCookies(&config); err != nil {
+		t.Fatalf("Could not configure cookies: [%v]", err)
+	}
+	client := []byte("clientck")
+	ip := net.ParseIP("192.0.2.1")
+	if !b.cookies.valid(client, serverCookie(a.cookies.secret, client, ip, time.Now()), ip) {
+		t.Errorf("Expected servers configured from the same config to accept each other's cookies")
+	}
+
+	config.Cookies.Secret = "c2hvcnQ="
+	if err := a.ConfigureCookies(&config); err == nil {
+		t.Errorf("Expected error for short secret")
+	}
+}
+
+func TestRotateCookieSecret(t *testing.T) {
+	config := setupConfig()
+	config.Cookies.Enabled = true
+	logger := zaptest.NewLogger(t)
+	a := NewDNSServer(logger, nil, config.Listen, "udp", config.Domain)
+	b := NewDNSServer(logger, nil, config.Listen, "tcp", config.Domain)
+	for _, d := range []*DNSServer{a, b} {
+		if err := d.ConfigureCookies(&config); err != nil {
+			t.Fatalf("Could not configure cookies: [%v]", err)
+		}
+	}
+	client := []byte("clientck")
+	ip := net.ParseIP("192.0.2.1")
+	first := serverCookie(a.cookies.secret, client, ip, time.Now())
+
+	// A reload without a configured secret generates a new one for all servers
+	reloaded := setupConfig()
+	reloaded.Cookies.Enabled = true
+	for _, d := range []*DNSServer{a, b} {
+		if err := d.RotateCookieSecret(&reloaded); err != nil {
+			t.Fatalf("Could not rotate the cookie secret: [%v]", err)
+		}
+	}
+	second := serverCookie(a.cookies.secret, client, ip, time.Now())
+	if string(first) == string(second) {
+		t.Errorf("Expected a new cookie secret after rotation")
+	}
+	for _, d := range []*DNSServer{a, b} {
+		if !d.cookies.valid(client, first, ip) || !d.cookies.valid(client, second, ip) {
+			t.Errorf("Expected cookies created with the current and previous secret to be valid")
+		}
+	}
+
+	// Only the previous secret is kept
+	reloaded.Cookies.Secret, reloaded.Cookies.PreviousSecret = "", ""
+	if err := a.RotateCookieSecret(&reloaded); err != nil {
+		t.Fatalf("Could not rotate the cookie secret: [%v]", err)
+	}
+	if a.cookies.valid(client, first, ip) || !a.cookies.valid(client, second, ip) {
+		t.Errorf("Expected only cookies created with the previous secret to be valid")
+	}
+
+	// A configured previous secret replaces the one kept from before
+	reloaded.Cookies.Secret = "MDEyMzQ1Njc4OWFiY2RlZg=="
+	reloaded.Cookies.PreviousSecret = "ZmVkY2JhOTg3NjU0MzIxMA=="
+	if err := a.RotateCookieSecret(&reloaded); err != nil {
+		t.Fatalf("Could not rotate the cookie secret: [%v]", err)
+	}
+	if a.cookies.valid(client, second, ip) || !a.cookies.valid(client, serverCookie([]byte("fedcba9876543210"), client, ip, time.Now()), ip) {
+		t.Errorf("Expected only cookies created with the configured secrets to be valid")
+	}
+
+	reloaded.Cookies.PreviousSecret = "c2hvcnQ="
+	if err := a.RotateCookieSecret(&reloaded); err == nil {
+		t.Errorf("Expected error for short previous secret")
+	}
+}
@@ -2,10 +2,12 @@ package dns
 
 import (
 	"fmt"
+	"net"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/jdpage/dnsacmed/pkg/db"
+	"github.com/jdpage/dnsacmed/pkg/model"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
@@ -21,129 +23,412 @@ type DNSServer struct {
 	DB              db.Database
 	Domain          string
 	Server          *dns.Server
-	SOA             dns.RR
 	PersonalKeyAuth string
-	Domains         map[string]Records
+	// Dnstap writes out the queries and responses if set
+	Dnstap *Dnstap
+	// QueryLog keeps the recent queries for each account if set
+	QueryLog *QueryLog
+
+	zones           *zoneStore
+	serial          *serialCache
+	transferACL     model.CIDRSlice
+	transferDeny    model.CIDRSlice
+	transferTSIGKey string
+	rateLimiter     *rateLimiter
+	cookies         *cookieJar
+	identity        *serverIdentity
+	queryACL        *queryACL
 }
 
 // NewDNSServer parses the DNS records from config and returns a new DNSServer struct
 func NewDNSServer(logger *zap.Logger, db db.Database, addr string, proto string, domain string) *DNSServer {
+	return newDNSServer(logger, db, &dns.Server{Addr: addr, Net: proto}, domain)
+}
+
+// NewDNSServerOnPacketConn returns a new DNSServer answering UDP queries on an
+// existing connection
+func NewDNSServerOnPacketConn(logger *zap.Logger, db db.Database, conn net.PacketConn, domain string) *DNSServer {
+	return newDNSServer(logger, db, &dns.Server{Addr: conn.LocalAddr().String(), Net: "udp", PacketConn: conn}, domain)
+}
+
+// NewDNSServerOnListener returns a new DNSServer answering TCP queries on an
+// existing listener
+func NewDNSServerOnListener(logger *zap.Logger, db db.Database, listener net.Listener, domain string) *DNSServer {
+	return newDNSServer(logger, db, &dns.Server{Addr: listener.Addr().String(), Net: "tcp", Listener: listener}, domain)
+}
+
+func newDNSServer(logger *zap.Logger, db db.Database, dnsServer *dns.Server, domain string) *DNSServer {
 	var server DNSServer
 	server.logger = logger
-	server.Server = &dns.Server{Addr: addr, Net: proto}
+	// Each server gets its own handler, so that several can run in one process
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", server.handleRequest)
+	dnsServer.Handler = mux
+	dnsServer.MsgAcceptFunc = acceptMsg
+	dnsServer.TsigProvider = tsigKeyring{db: db}
+	server.Server = dnsServer
 	if !strings.HasSuffix(domain, ".") {
 		domain = domain + "."
 	}
 	server.Domain = strings.ToLower(domain)
 	server.DB = db
 	server.PersonalKeyAuth = ""
-	server.Domains = make(map[string]Records)
+	server.zones = newZoneStore()
+	if db != nil {
+		server.serial = &serialCache{}
+		db.Subscribe(server.serial.invalidate)
+	}
 	return &server
 }
 
 // Start starts the DNSServer
 func (d *DNSServer) Start(errorChannel chan error) {
-	// DNS server part
-	dns.HandleFunc(".", d.handleRequest)
 	d.logger.Info("Listening DNS", zap.String("addr", d.Server.Addr), zap.String("proto", d.Server.Net))
-	err := d.Server.ListenAndServe()
+	var err error
+	if d.Server.PacketConn != nil || d.Server.Listener != nil {
+		err = d.Server.ActivateAndServe()
+	} else {
+		err = d.Server.ListenAndServe()
+	}
 	if err != nil {
 		errorChannel <- err
 	}
 }
 
-// ParseRecords parses a slice of DNS record string
-func (d *DNSServer) ParseRecords(config *Config) {
-	for _, v := range config.StaticRecords {
-		rr, err := dns.NewRR(strings.ToLower(v))
-		if err != nil {
-			d.logger.Warn("Could not parse RR from config", zap.Error(err), zap.String("rr", v))
-			continue
-		}
-		// Add parsed RR
-		d.appendRR(rr)
+// acceptMsg works like dns.DefaultMsgAcceptFunc, but lets RFC 2136 updates through
+// and rejects opcodes other than QUERY and UPDATE as not implemented
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	opcode := int(dh.Bits>>11) & 0xF
+	if isResponse := dh.Bits&(1<<15) != 0; isResponse {
+		return dns.MsgIgnore
 	}
-	// Create serial
-	serial := time.Now().Format("2006010215")
-	// Add SOA
-	SOAstring := fmt.Sprintf("%s. SOA %s. %s. %s 28800 7200 604800 86400", strings.ToLower(config.Domain), strings.ToLower(config.NSName), strings.ToLower(config.NSAdmin), serial)
-	soarr, err := dns.NewRR(SOAstring)
-	if err != nil {
-		d.logger.Error("While adding SOA record", zap.Error(err), zap.String("soa", SOAstring))
-	} else {
-		d.appendRR(soarr)
-		d.SOA = soarr
+	switch opcode {
+	case dns.OpcodeQuery:
+		return dns.DefaultMsgAcceptFunc(dh)
+	case dns.OpcodeUpdate:
+		// The zone section holds exactly one zone, the other sections any number of records
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
 	}
+	return dns.MsgRejectNotImplemented
 }
 
-func (d *DNSServer) appendRR(rr dns.RR) {
-	addDomain := rr.Header().Name
-	_, ok := d.Domains[addDomain]
-	if !ok {
-		d.Domains[addDomain] = Records{[]dns.RR{rr}}
-	} else {
-		drecs := d.Domains[addDomain]
-		drecs.Records = append(drecs.Records, rr)
-		d.Domains[addDomain] = drecs
+func (d *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if d.Dnstap != nil {
+		w = d.Dnstap.wrap(w, r, d.socketProtocol(w))
+	}
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+		if len(r.Question) == 1 {
+			// Zone transfers have their own access control
+			if qtype := r.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+				d.handleTransfer(w, r)
+				return
+			}
+		}
+		if d.refuseQuery(w, r) {
+			return
+		}
+		if len(r.Question) == 1 {
+			if rcode, ok := metaQueryRcode(r.Question[0].Qtype); ok {
+				m := new(dns.Msg)
+				m.SetRcode(r, rcode)
+				_ = w.WriteMsg(m)
+				return
+			}
+		}
+	case dns.OpcodeUpdate:
+		if d.refuseQuery(w, r) {
+			return
+		}
+		d.handleUpdate(w, r)
+		return
+	default:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		_ = w.WriteMsg(m)
+		return
 	}
-	d.logger.Debug("Adding new record to domain", zap.String("recordtype", dns.TypeToString[rr.Header().Rrtype]), zap.String("domain", addDomain))
-}
 
-func (d *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 
 	// handle edns0
+	var client []byte
+	cookie := cookieNone
+	ip, _ := remoteIP(w.RemoteAddr())
 	opt := r.IsEdns0()
 	if opt != nil {
 		if opt.Version() != 0 {
 			// Only EDNS0 is standardized
 			m.MsgHdr.Rcode = dns.RcodeBadVers
-			m.SetEdns0(512, false)
+			m.SetEdns0(d.zone().maxUDPSize, false)
 		} else {
 			// We can safely do this as we know that we're not setting other OPT RRs within acme-dns.
-			m.SetEdns0(512, false)
-			if r.Opcode == dns.OpcodeQuery {
-				d.readQuery(m)
+			m.SetEdns0(d.zone().maxUDPSize, opt.Do())
+			if d.cookies != nil {
+				client, cookie = d.cookies.readCookie(opt, ip)
+			}
+			if cookie == cookieMalformed {
+				m.MsgHdr.Rcode = dns.RcodeFormatError
+			} else {
+				name := d.readQuery(m)
+				if opt.Do() {
+					d.signResponse(m, name)
+				}
 			}
 		}
 	} else {
-		if r.Opcode == dns.OpcodeQuery {
-			d.readQuery(m)
+		d.readQuery(m)
+	}
+	// A valid server cookie proves that the client address is not spoofed
+	if d.rateLimiter != nil && cookie != cookieValid {
+		if action := d.rateLimiter.check(w.RemoteAddr(), m); action != rateLimitSend {
+			switch {
+			case cookie == cookieClientOnly && d.cookies.requireWhenLimited:
+				rateLimitBadCookie.Add(1)
+				m = badCookie(m)
+			case action == rateLimitSlip:
+				rateLimitSlipped.Add(1)
+				m = truncated(m)
+			default:
+				rateLimitDropped.Add(1)
+				d.logQuery(ip, r, nil)
+				return
+			}
 		}
 	}
+	if client != nil {
+		d.cookies.addCookie(m, client, ip)
+	}
+	if opt != nil && opt.Version() == 0 {
+		d.addNSID(m, opt)
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		// Leave out what doesn't fit and set TC, so that the client retries over TCP
+		m.Truncate(d.udpSize(opt))
+	}
+	d.logQuery(ip, r, m)
 	_ = w.WriteMsg(m)
 }
 
-func (d *DNSServer) readQuery(m *dns.Msg) {
+// metaQueryRcode returns the rcode to answer queries for meta types other than ANY
+// and zone transfers with. Transaction signatures can't be asked for, and the obsolete
+// mailbox types are not implemented. OPT queries are answered like any type without
+// records, as some EDNS probes send them.
+func metaQueryRcode(qtype uint16) (int, bool) {
+	switch qtype {
+	case dns.TypeTSIG, dns.TypeTKEY:
+		return dns.RcodeFormatError, true
+	case dns.TypeMAILA, dns.TypeMAILB:
+		return dns.RcodeNotImplemented, true
+	}
+	return 0, false
+}
+
+// udpSize returns the size of the largest UDP answer the client accepts, capped
+// at the configured maximum
+func (d *DNSServer) udpSize(opt *dns.OPT) int {
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size := int(opt.UDPSize())
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if limit := int(d.zone().maxUDPSize); size > limit {
+		size = limit
+	}
+	return size
+}
+
+// readQuery answers the questions of the message from the client. The name the
+// answer is for is returned, which is the end of the CNAME chain followed, if any.
+func (d *DNSServer) readQuery(m *dns.Msg) string {
 	var authoritative = false
+	var negative = false
+	var last string
 	for _, que := range m.Question {
 		if rr, rc, auth, err := d.answer(que); err == nil {
 			if auth {
 				authoritative = auth
 			}
+			rr, last, rc = d.chaseCNAME(que, rr, rc)
 			m.MsgHdr.Rcode = rc
 			m.Answer = append(m.Answer, rr...)
+			negative = rc == dns.RcodeNameError || (rc == dns.RcodeSuccess && !ownsRecord(rr, last))
 		}
 	}
 	m.MsgHdr.Authoritative = authoritative
 	if authoritative {
-		if m.MsgHdr.Rcode == dns.RcodeNameError {
-			m.Ns = append(m.Ns, d.SOA)
+		// Both NXDOMAIN and NODATA answers need the SOA for negative caching (RFC 2308),
+		// from the zone of the name the CNAME chain ended at
+		if negative {
+			m.Ns = append(m.Ns, d.withSerial(d.zoneSOA(last)))
 		}
+		m.Extra = append(m.Extra, d.additional(m.Answer)...)
+	}
+	return last
+}
+
+// maxCNAMEChain is the number of CNAME records followed before giving up
+const maxCNAMEChain = 8
+
+// chaseCNAME follows the CNAME records of an answer to names in our zones, appending
+// their answers. The name the chain ended at is returned, with its rcode (RFC 6604).
+func (d *DNSServer) chaseCNAME(q dns.Question, rr []dns.RR, rcode int) ([]dns.RR, string, int) {
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+		return rr, q.Name, rcode
+	}
+	seen := map[string]bool{strings.ToLower(q.Name): true}
+	answer := rr
+	for i := 0; i < maxCNAMEChain; i++ {
+		var target string
+		for _, r := range answer {
+			if cname, ok := r.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, q.Name) {
+				target = cname.Target
+				break
+			}
+		}
+		if target == "" {
+			break
+		}
+		if seen[strings.ToLower(target)] {
+			d.logger.Warn("CNAME loop", zap.String("domain", q.Name), zap.String("target", target))
+			break
+		}
+		seen[strings.ToLower(target)] = true
+		next := dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}
+		if !d.isAuthoritative(next) {
+			// The client resolves names outside of our zones itself
+			break
+		}
+		var err error
+		answer, rcode, _, err = d.answer(next)
+		if err != nil {
+			break
+		}
+		rr = append(rr, answer...)
+		q = next
+	}
+	return rr, q.Name, rcode
+}
+
+// ownsRecord checks if any of the records is owned by the name
+func ownsRecord(rr []dns.RR, name string) bool {
+	for _, r := range rr {
+		if strings.EqualFold(r.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// additional returns the addresses of the NS, MX and SRV targets in the records that
+// we have static records for, to save the client from looking them up
+func (d *DNSServer) additional(rr []dns.RR) []dns.RR {
+	var extra []dns.RR
+	seen := make(map[string]bool)
+	for _, r := range rr {
+		var target string
+		switch r := r.(type) {
+		case *dns.NS:
+			target = r.Ns
+		case *dns.MX:
+			target = r.Mx
+		case *dns.SRV:
+			target = r.Target
+		}
+		target = strings.ToLower(target)
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		domain, ok := d.zone().domains[target]
+		if !ok {
+			continue
+		}
+		for _, ri := range domain.Records {
+			if t := ri.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				extra = append(extra, ri)
+			}
+		}
+	}
+	return extra
+}
+
+// serialCache holds the zone serial read from the database, until a change of the
+// database invalidates it
+type serialCache struct {
+	sync.Mutex
+	serial uint32
+	valid  bool
+	// generation counts the invalidations, so that a serial read before one of
+	// them is not kept
+	generation uint64
+}
+
+func (c *serialCache) invalidate(string) {
+	c.Lock()
+	defer c.Unlock()
+	c.valid = false
+	c.generation++
+}
+
+// get returns the cached serial, reading it from the database if needed. Servers
+// whose database was set after they were created don't cache it.
+func (c *serialCache) get(db db.Database) (uint32, error) {
+	if c == nil {
+		return db.GetSerial()
+	}
+	c.Lock()
+	if c.valid {
+		defer c.Unlock()
+		return c.serial, nil
+	}
+	generation := c.generation
+	c.Unlock()
+	serial, err := db.GetSerial()
+	if err != nil {
+		return 0, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.generation == generation {
+		c.serial, c.valid = serial, true
 	}
+	return serial, nil
+}
+
+// withSerial returns a copy of a SOA record carrying the current zone serial from
+// the database. Other records are returned as-is.
+func (d *DNSServer) withSerial(rr dns.RR) dns.RR {
+	soa, ok := rr.(*dns.SOA)
+	if !ok || d.DB == nil {
+		return rr
+	}
+	serial, err := d.serial.get(d.DB)
+	if err != nil {
+		d.logger.Error("While trying to get zone serial", zap.Error(err))
+		return rr
+	}
+	soa = dns.Copy(soa).(*dns.SOA)
+	soa.Serial = serial
+	return soa
 }
 
 func (d *DNSServer) getRecord(q dns.Question) ([]dns.RR, error) {
 	var rr []dns.RR
 	var cnames []dns.RR
-	domain, ok := d.Domains[strings.ToLower(q.Name)]
+	domain, ok := d.zone().domains[strings.ToLower(q.Name)]
 	if !ok {
 		return rr, fmt.Errorf("No records for domain %s", q.Name)
 	}
 	for _, ri := range domain.Records {
 		if ri.Header().Rrtype == q.Qtype {
-			rr = append(rr, ri)
+			rr = append(rr, d.withSerial(ri))
 		}
 		if ri.Header().Rrtype == dns.TypeCNAME {
 			cnames = append(cnames, ri)
@@ -157,13 +442,127 @@ func (d *DNSServer) getRecord(q dns.Question) ([]dns.RR, error) {
 
 // answeringForDomain checks if we have any records for a domain
 func (d *DNSServer) answeringForDomain(name string) bool {
-	if d.Domain == strings.ToLower(name) {
+	if d.answeringForZone(strings.ToLower(name)) {
+		return true
+	}
+	_, ok := d.zone().domains[strings.ToLower(name)]
+	return ok
+}
+
+// findZone returns the name of the closest enclosing zone of a name, if any
+func (d *DNSServer) findZone(name string) (string, bool) {
+	name = strings.ToLower(name)
+	for {
+		if d.answeringForZone(name) {
+			return name, true
+		}
+		dot := strings.Index(name, ".")
+		if dot < 0 || dot == len(name)-1 {
+			return "", false
+		}
+		name = name[dot+1:]
+	}
+}
+
+// zoneSOA returns the SOA record of the zone the name belongs to, falling back to
+// the SOA of the default zone
+func (d *DNSServer) zoneSOA(name string) dns.RR {
+	if zone, ok := d.findZone(name); ok {
+		if soa, ok := d.zone().zones[zone]; ok {
+			return soa
+		}
+	}
+	return d.zone().soa
+}
+
+// isEmptyNonTerminal checks if the name has no records of its own, but some of the
+// names below it do
+func (d *DNSServer) isEmptyNonTerminal(name string) bool {
+	suffix := "." + strings.ToLower(name)
+	for domain := range d.zone().domains {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// answeringForZone checks if the name is the apex of one of our zones
+func (d *DNSServer) answeringForZone(name string) bool {
+	if name == d.Domain {
 		return true
 	}
-	_, ok := d.Domains[strings.ToLower(name)]
+	_, ok := d.zone().zones[name]
 	return ok
 }
 
+// accountName splits a name directly below the apex of one of our zones into the
+// subdomain of an account and the zone. Zones may be nested, eg. a zone for a tenant
+// below the default zone.
+func (d *DNSServer) accountName(name string) (string, string, bool) {
+	domainParts := strings.SplitN(strings.ToLower(name), ".", 2)
+	if len(domainParts) != 2 || !d.answeringForZone(domainParts[1]) {
+		return "", "", false
+	}
+	return domainParts[0], domainParts[1], true
+}
+
+// isAccount checks if the name belongs to a registered account, in the zone the
+// account was registered in
+func (d *DNSServer) isAccount(name string) bool {
+	if d.DB == nil {
+		return false
+	}
+	subdomain, zone, ok := d.accountName(name)
+	if !ok {
+		return false
+	}
+	accountZone, exists, err := d.DB.GetAccountZone(subdomain)
+	if err != nil {
+		d.logger.Error("While checking if subdomain exists", zap.Error(err))
+		return false
+	}
+	return exists && d.zoneName(accountZone) == zone
+}
+
+// nameExists checks if a name exists in the zone, even if it has no records of the
+// queried type. Names that don't exist get NXDOMAIN, others NODATA.
+func (d *DNSServer) nameExists(name string) bool {
+	return d.isOwnChallenge(name) || d.answeringForDomain(name) || d.isEmptyNonTerminal(name) || d.isAccount(name)
+}
+
+// wildcardSource returns the wildcard whose records are synthesized for a name that
+// does not exist (RFC 4592). Only a wildcard directly below the closest existing
+// ancestor of the name applies, so wildcards never cover accounts or names below them.
+func (d *DNSServer) wildcardSource(name string) (string, bool) {
+	name = strings.ToLower(name)
+	for {
+		dot := strings.Index(name, ".")
+		if dot < 0 || dot == len(name)-1 {
+			return "", false
+		}
+		name = name[dot+1:]
+		if d.nameExists(name) {
+			source := "*." + name
+			_, ok := d.zone().domains[source]
+			return source, ok
+		}
+	}
+}
+
+// synthesize answers the question with copies of the records of a wildcard, owned
+// by the name asked for
+func (d *DNSServer) synthesize(q dns.Question, source string) []dns.RR {
+	records, _ := d.getRecord(dns.Question{Name: source, Qtype: q.Qtype, Qclass: q.Qclass})
+	var rr []dns.RR
+	for _, r := range records {
+		r = dns.Copy(r)
+		r.Header().Name = q.Name
+		rr = append(rr, r)
+	}
+	return rr
+}
+
 func (d *DNSServer) isAuthoritative(q dns.Question) bool {
 	if d.answeringForDomain(q.Name) {
 		return true
@@ -198,11 +597,35 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 	var rcode int
 	var err error
 	var txtRRs []dns.RR
+	switch q.Qclass {
+	case dns.ClassCHAOS:
+		r, rcode, authoritative := d.answerChaos(q)
+		return r, rcode, authoritative, nil
+	case dns.ClassINET, dns.ClassANY:
+	default:
+		// There are no records in the other classes
+		return nil, dns.RcodeRefused, false, nil
+	}
 	var authoritative = d.isAuthoritative(q)
-	if !d.isOwnChallenge(q.Name) && !d.answeringForDomain(q.Name) {
-		rcode = dns.RcodeNameError
+	if !authoritative {
+		// Names outside of our zones are not ours to answer
+		d.logger.Debug("Refusing question outside of our zones", zap.String("qtype", dns.TypeToString[q.Qtype]), zap.String("domain", q.Name))
+		return nil, dns.RcodeRefused, false, nil
+	}
+	if q.Qtype == dns.TypeANY {
+		r, rcode := d.answerANY(q)
+		d.logger.Debug("Answering ANY question for domain", zap.String("domain", q.Name), zap.String("rcode", dns.RcodeToString[rcode]))
+		return r, rcode, authoritative, nil
 	}
 	r, _ := d.getRecord(q)
+	if !d.nameExists(q.Name) {
+		rcode = dns.RcodeNameError
+		if source, ok := d.wildcardSource(q.Name); ok {
+			// The wildcard makes the name exist, even without records of the type
+			rcode = dns.RcodeSuccess
+			r = d.synthesize(q, source)
+		}
+	}
 	if q.Qtype == dns.TypeTXT {
 		if d.isOwnChallenge(q.Name) {
 			txtRRs, err = d.answerOwnChallenge(q)
@@ -221,9 +644,40 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 	return r, rcode, authoritative, nil
 }
 
+// anyTTL is the TTL of the HINFO record answering ANY queries
+const anyTTL = 3600
+
+// answerANY answers ANY queries with a single synthesized HINFO record (RFC 8482),
+// so that they can neither list the records at a name nor amplify attacks
+func (d *DNSServer) answerANY(q dns.Question) ([]dns.RR, int) {
+	if !d.nameExists(q.Name) {
+		if _, ok := d.wildcardSource(q.Name); !ok {
+			return nil, dns.RcodeNameError
+		}
+	}
+	hinfo := &dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyTTL},
+		Cpu: "RFC8482",
+	}
+	return []dns.RR{hinfo}, dns.RcodeSuccess
+}
+
+// answerTXT answers with the TXT values of an account. Only the exact name of the
+// account in its zone is answered.
 func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
 	var ra []dns.RR
-	subdomain := sanitizeDomainQuestion(q.Name)
+	subdomain, zone, ok := d.accountName(q.Name)
+	if !ok {
+		return ra, nil
+	}
+	accountZone, exists, err := d.DB.GetAccountZone(subdomain)
+	if err != nil {
+		d.logger.Error("While trying to get record", zap.Error(err))
+		return ra, err
+	}
+	if !exists || d.zoneName(accountZone) != zone {
+		return ra, nil
+	}
 	atxt, err := d.DB.GetTXTForDomain(subdomain)
 	if err != nil {
 		d.logger.Error("While trying to get record", zap.Error(err))
@@ -232,7 +686,7 @@ func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
 	for _, v := range atxt {
 		if len(v) > 0 {
 			r := new(dns.TXT)
-			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
+			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: d.zone().txtTTL}
 			r.Txt = append(r.Txt, v)
 			ra = append(ra, r)
 		}
@@ -243,16 +697,7 @@ func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
 // answerOwnChallenge answers to ACME challenge for acme-dns own certificate
 func (d *DNSServer) answerOwnChallenge(q dns.Question) ([]dns.RR, error) {
 	r := new(dns.TXT)
-	r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
+	r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: d.zone().txtTTL}
 	r.Txt = append(r.Txt, d.PersonalKeyAuth)
 	return []dns.RR{r}, nil
 }
-
-func sanitizeDomainQuestion(d string) string {
-	dom := strings.ToLower(d)
-	firstDot := strings.Index(d, ".")
-	if firstDot > 0 {
-		dom = dom[0:firstDot]
-	}
-	return dom
-}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"testing"
 
@@ -27,7 +29,6 @@ var records = []string{
 	"auth.example.org. A 192.168.1.100",
 	"ns1.auth.example.org. A 192.168.1.101",
 	"cn.example.org CNAME something.example.org.",
-	"!''b', unparseable ",
 	"ns2.auth.example.org. A 192.168.1.102",
 }
 
@@ -85,7 +86,23 @@ func setupDB(t *testing.T, logger *zap.Logger) db.Database {
 func setupDNSServer(config Config, logger *zap.Logger, db db.Database) (*DNSServer, func() error) {
 	dnsserver := NewDNSServer(logger, db, config.Listen, config.Proto, config.Domain)
 	dnsserver.ParseRecords(&config)
+	return dnsserver, startDNSServer(dnsserver)
+}
 
+// setupConfiguredDNSServer works like setupDNSServer, but also applies the transfer, rate limiting
+// and cookie options before the server starts
+func setupConfiguredDNSServer(t *testing.T, config Config, logger *zap.Logger, db db.Database) (*DNSServer, func() error) {
+	dnsserver := NewDNSServer(logger, db, config.Listen, config.Proto, config.Domain)
+	dnsserver.ParseRecords(&config)
+	for _, configure := range []func(*Config) error{dnsserver.ConfigureTransfers, dnsserver.ConfigureRateLimit, dnsserver.ConfigureCookies, dnsserver.ConfigureQueryACL} {
+		if err := configure(&config); err != nil {
+			t.Fatalf("Could not configure server: [%v]", err)
+		}
+	}
+	return dnsserver, startDNSServer(dnsserver)
+}
+
+func startDNSServer(dnsserver *DNSServer) func() error {
 	// Make sure that the server has finished starting up before continuing
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -93,7 +110,7 @@ func setupDNSServer(config Config, logger *zap.Logger, db db.Database) (*DNSServ
 	go dnsserver.Start(make(chan error, 1))
 	wg.Wait()
 
-	return dnsserver, dnsserver.Server.Shutdown
+	return dnsserver.Server.Shutdown
 }
 
 func setupConfig() Config {
@@ -130,7 +147,7 @@ func TestQuestionDBError(t *testing.T) {
 	db.SetBackend(tdb)
 	defer db.SetBackend(oldDb)
 
-	q := dns.Question{Name: dns.Fqdn("whatever.tld"), Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+	q := dns.Question{Name: dns.Fqdn("whatever.auth.example.org"), Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
 	_, err = dnsServer.answerTXT(q)
 	if err == nil {
 		t.Errorf("Expected error but got none")
@@ -265,6 +282,167 @@ func TestResolveCNAME(t *testing.T) {
 	}
 }
 
+func TestCNAMEChasing(t *testing.T) {
+	config := setupConfig()
+	config.StaticRecords = append(append([]string{}, records...),
+		"www.auth.example.org. CNAME web.auth.example.org.",
+		"web.auth.example.org. CNAME host.auth.example.org.",
+		"host.auth.example.org. A 192.0.2.1",
+		"dangling.auth.example.org. CNAME missing.auth.example.org.",
+		"external.auth.example.org. CNAME www.example.com.",
+		"loop1.auth.example.org. CNAME loop2.auth.example.org.",
+		"loop2.auth.example.org. CNAME loop1.auth.example.org.",
+	)
+	logger := zaptest.NewLogger(t)
+	_, stop := setupDNSServer(config, logger, nil)
+	defer stop()
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for _, test := range []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		soa     bool
+	}{
+		{"www.auth.example.org", dns.TypeA, dns.RcodeSuccess, 3, false},
+		// The chain ends at a name without records of the type
+		{"www.auth.example.org", dns.TypeAAAA, dns.RcodeSuccess, 2, true},
+		// The rcode is that of the end of the chain
+		{"dangling.auth.example.org", dns.TypeA, dns.RcodeNameError, 1, true},
+		// Names outside of our zones are left to the client
+		{"external.auth.example.org", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"loop1.auth.example.org", dns.TypeA, dns.RcodeSuccess, 2, false},
+		// CNAME queries are answered with the CNAME only
+		{"www.auth.example.org", dns.TypeCNAME, dns.RcodeSuccess, 1, false},
+	} {
+		answer, _ := resolv.lookup(test.name, test.qtype)
+		if answer == nil {
+			t.Fatalf("No answer for %s", test.name)
+		}
+		if answer.Rcode != test.rcode {
+			t.Errorf("Expected %s for %s %s, but got %s", dns.RcodeToString[test.rcode], test.name, dns.TypeToString[test.qtype], dns.RcodeToString[answer.Rcode])
+		}
+		if len(answer.Answer) != test.answers {
+			t.Errorf("Expected %d records for %s %s, but got %v", test.answers, test.name, dns.TypeToString[test.qtype], answer.Answer)
+		}
+		if hasSOA := len(answer.Ns) == 1 && answer.Ns[0].Header().Rrtype == dns.TypeSOA; hasSOA != test.soa {
+			t.Errorf("Expected SOA in authority section to be %t for %s %s, but got %v", test.soa, test.name, dns.TypeToString[test.qtype], answer.Ns)
+		}
+	}
+}
+
+func TestAdditionalGlue(t *testing.T) {
+	config := setupConfig()
+	config.StaticRecords = append(append([]string{}, records...),
+		"auth.example.org. NS ns1.auth.example.org.",
+		"auth.example.org. NS ns.example.com.",
+		"ns1.auth.example.org. AAAA 2001:db8::101",
+		"auth.example.org. MX 10 mail.auth.example.org.",
+		"mail.auth.example.org. A 192.0.2.25",
+		"_sip._tcp.auth.example.org. SRV 10 5 5060 ns2.auth.example.org.",
+	)
+	logger := zaptest.NewLogger(t)
+	_, stop := setupDNSServer(config, logger, nil)
+	defer stop()
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+		extra []string
+	}{
+		{"auth.example.org", dns.TypeNS, []string{"192.168.1.101", "2001:db8::101"}},
+		{"auth.example.org", dns.TypeMX, []string{"192.0.2.25"}},
+		{"_sip._tcp.auth.example.org", dns.TypeSRV, []string{"192.168.1.102"}},
+		{"auth.example.org", dns.TypeA, nil},
+	} {
+		answer, err := resolv.lookup(test.name, test.qtype)
+		if err != nil {
+			t.Fatalf("Unexpected error [%v]", err)
+		}
+		var extra []string
+		for _, rr := range answer.Extra {
+			switch rr := rr.(type) {
+			case *dns.A:
+				extra = append(extra, rr.A.String())
+			case *dns.AAAA:
+				extra = append(extra, rr.AAAA.String())
+			}
+		}
+		if fmt.Sprint(extra) != fmt.Sprint(test.extra) {
+			t.Errorf("Expected additional addresses %v for %s %s, but got %v", test.extra, test.name, dns.TypeToString[test.qtype], extra)
+		}
+	}
+}
+
+func TestANYQuery(t *testing.T) {
+	config := setupConfig()
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	_, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for _, test := range []struct {
+		name  string
+		rcode int
+	}{
+		{"auth.example.org", dns.RcodeSuccess},
+		{atxt.Subdomain + ".auth.example.org", dns.RcodeSuccess},
+		{"nonexistent.auth.example.org", dns.RcodeNameError},
+		{"example.com", dns.RcodeRefused},
+	} {
+		answer, _ := resolv.lookup(test.name, dns.TypeANY)
+		if answer == nil {
+			t.Fatalf("No answer for %s", test.name)
+		}
+		if answer.Rcode != test.rcode {
+			t.Errorf("Expected %s for %s, but got %s", dns.RcodeToString[test.rcode], test.name, dns.RcodeToString[answer.Rcode])
+		}
+		if test.rcode != dns.RcodeSuccess {
+			continue
+		}
+		if len(answer.Answer) != 1 {
+			t.Errorf("Expected a single record for %s, but got %v", test.name, answer.Answer)
+			continue
+		}
+		if hinfo, ok := answer.Answer[0].(*dns.HINFO); !ok || hinfo.Cpu != "RFC8482" {
+			t.Errorf("Expected synthesized HINFO record for %s, but got %v", test.name, answer.Answer[0])
+		}
+	}
+}
+
+func TestMetaQueryTypes(t *testing.T) {
+	config := setupConfig()
+	logger := zaptest.NewLogger(t)
+	_, stop := setupDNSServer(config, logger, nil)
+	defer stop()
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for qtype, rcode := range map[uint16]int{
+		dns.TypeTSIG:  dns.RcodeFormatError,
+		dns.TypeTKEY:  dns.RcodeFormatError,
+		dns.TypeMAILA: dns.RcodeNotImplemented,
+		dns.TypeMAILB: dns.RcodeNotImplemented,
+		// Zone transfers are only done over TCP
+		dns.TypeAXFR: dns.RcodeRefused,
+	} {
+		answer, _ := resolv.lookup("auth.example.org", qtype)
+		if answer == nil {
+			t.Fatalf("No answer for %s", dns.TypeToString[qtype])
+		}
+		if answer.Rcode != rcode || len(answer.Answer) != 0 {
+			t.Errorf("Expected %s for %s, but got %s with %v", dns.RcodeToString[rcode], dns.TypeToString[qtype], dns.RcodeToString[answer.Rcode], answer.Answer)
+		}
+	}
+}
+
 func TestAuthoritative(t *testing.T) {
 	config := setupConfig()
 	logger := zaptest.NewLogger(t)
@@ -304,7 +482,7 @@ func TestResolveTXT(t *testing.T) {
 	resolv := resolver{server: "127.0.0.1:15353"}
 	validTXT := "______________valid_response_______________"
 
-	atxt, err := db.Register(model.CIDRSlice{})
+	atxt, err := db.Register(model.CIDRSlice{}, "")
 	if err != nil {
 		t.Errorf("Could not initiate db record: [%v]", err)
 		return
@@ -394,3 +572,457 @@ func TestCaseInsensitiveResolveSOA(t *testing.T) {
 		t.Error("No SOA answer for DNS query")
 	}
 }
+
+func TestConfiguredTTLs(t *testing.T) {
+	config := setupConfig()
+	config.TXTTTL = 30
+	config.SOATTL = 300
+	config.SOARefresh = 3600
+	config.SOARetry = 600
+	config.SOAExpire = 86400
+	config.SOAMinimum = 60
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	_, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	answer, err := resolv.lookup("auth.example.org", dns.TypeSOA)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("Expected exactly 1 RR in answer, but got %d instead.", len(answer.Answer))
+	}
+	soa, ok := answer.Answer[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("Expected a SOA answer, but got [%s] instead.", answer.Answer[0])
+	}
+	if soa.Hdr.Ttl != 300 || soa.Refresh != 3600 || soa.Retry != 600 || soa.Expire != 86400 || soa.Minttl != 60 {
+		t.Errorf("SOA record [%s] does not match the configured TTL and timers", soa)
+	}
+
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________valid_response_______________"
+	if err = db.Update(&atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+	answer, err = resolv.lookup(atxt.Subdomain+".auth.example.org", dns.TypeTXT)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("Expected exactly 1 RR in answer, but got %d instead.", len(answer.Answer))
+	}
+	if answer.Answer[0].Header().Ttl != 30 {
+		t.Errorf("Expected TXT TTL 30, but got %d", answer.Answer[0].Header().Ttl)
+	}
+}
+
+func TestSerialChangesOnUpdate(t *testing.T) {
+	config := setupConfig()
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	_, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	getSerial := func() uint32 {
+		answer, err := resolv.lookup("auth.example.org", dns.TypeSOA)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(answer.Answer) != 1 {
+			t.Fatalf("Expected exactly 1 RR in answer, but got %d instead.", len(answer.Answer))
+		}
+		return answer.Answer[0].(*dns.SOA).Serial
+	}
+
+	before := getSerial()
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________valid_response_______________"
+	if err = db.Update(&atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+	if after := getSerial(); after != before+1 {
+		t.Errorf("Expected serial to be incremented from %d, but got %d", before, after)
+	}
+
+	// NXDOMAIN answers carry the current serial as well
+	answer, _ := resolv.lookup("nonexistent.auth.example.org", dns.TypeA)
+	if len(answer.Ns) != 1 || answer.Ns[0].(*dns.SOA).Serial != before+1 {
+		t.Errorf("Expected SOA with serial %d in authority section, but got %v", before+1, answer.Ns)
+	}
+}
+
+func TestSerialCache(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	dnsServer := NewDNSServer(logger, db, "127.0.0.1:15353", "udp", "auth.example.org")
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "auth.example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}}
+	before := dnsServer.withSerial(soa).(*dns.SOA).Serial
+
+	// Changes that bypass the database methods aren't seen until the next announced change
+	_, _ = db.GetBackend().Exec("UPDATE acmedns SET Value=CAST(CAST(Value AS BIGINT) + 10 AS TEXT) WHERE Name='serial'")
+	if cached := dnsServer.withSerial(soa).(*dns.SOA).Serial; cached != before {
+		t.Errorf("Expected cached serial %d, but got %d", before, cached)
+	}
+	if err := db.BumpSerial(); err != nil {
+		t.Fatalf("Could not bump serial: [%v]", err)
+	}
+	if after := dnsServer.withSerial(soa).(*dns.SOA).Serial; after != before+11 {
+		t.Errorf("Expected serial %d after the change, but got %d", before+11, after)
+	}
+}
+
+func TestNODATA(t *testing.T) {
+	config := setupConfig()
+	config.StaticRecords = append(config.StaticRecords, "a.b.auth.example.org. A 192.168.1.103")
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	_, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"auth.example.org", dns.TypeAAAA},
+		{"b.auth.example.org", dns.TypeA},
+		{atxt.Subdomain + ".auth.example.org", dns.TypeA},
+		{atxt.Subdomain + ".auth.example.org", dns.TypeTXT},
+	} {
+		t.Run(test.name+" "+dns.TypeToString[test.qtype], func(t *testing.T) {
+			answer, err := resolv.lookup(test.name, test.qtype)
+			if err != nil {
+				t.Fatalf("Was expecting NOERROR, but got: %v", err)
+			}
+			if len(answer.Answer) != 0 {
+				t.Errorf("Was expecting no answers, but got %v", answer.Answer)
+			}
+			if len(answer.Ns) != 1 || answer.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Errorf("Was expecting SOA in authority section, but got %v", answer.Ns)
+			}
+			if !answer.MsgHdr.Authoritative {
+				t.Errorf("Was expecting authoritative bit to be set")
+			}
+		})
+	}
+}
+
+func TestMultipleZones(t *testing.T) {
+	config := setupConfig()
+	config.Zones = []ZoneConfig{{
+		Domain:        "acme.eu.example.com",
+		NSName:        "ns1.acme.eu.example.com",
+		NSAdmin:       "admin.example.com",
+		StaticRecords: []string{"acme.eu.example.com. A 192.168.2.100"},
+		SOARefresh:    3600,
+		SOARetry:      600,
+	}}
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	_, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	answer, err := resolv.lookup("acme.eu.example.com", dns.TypeA)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Errorf("Expected exactly 1 RR in answer, but got %d instead.", len(answer.Answer))
+	}
+
+	answer, err = resolv.lookup("acme.eu.example.com", dns.TypeSOA)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	soa, ok := answer.Answer[0].(*dns.SOA)
+	if !ok || soa.Ns != "ns1.acme.eu.example.com." || soa.Refresh != 3600 || soa.Expire != DefaultSOAExpire {
+		t.Errorf("Unexpected SOA for additional zone: [%s]", answer.Answer[0])
+	}
+
+	answer, _ = resolv.lookup("nonexistent.acme.eu.example.com", dns.TypeA)
+	if answer.Rcode != dns.RcodeNameError {
+		t.Errorf("Was expecting NXDOMAIN rcode, but got [%s] instead.", dns.RcodeToString[answer.Rcode])
+	}
+	if len(answer.Ns) != 1 || answer.Ns[0].Header().Name != "acme.eu.example.com." {
+		t.Errorf("Was expecting SOA of the additional zone in authority section, but got %v", answer.Ns)
+	}
+
+	// Accounts exist in any zone
+	atxt, err := db.Register(model.CIDRSlice{}, "acme.eu.example.com")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________valid_response_______________"
+	if err = db.Update(&atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+	answer, err = resolv.lookup(atxt.Subdomain+".acme.eu.example.com", dns.TypeTXT)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = hasExpectedTXTAnswer(answer.Answer, atxt.Value); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestStrictTXTMatching(t *testing.T) {
+	config := setupConfig()
+	// A tenant zone nested below the default zone
+	config.Zones = []ZoneConfig{{Domain: "tenant.auth.example.org", NSName: "ns1.auth.example.org", NSAdmin: "admin.example.org"}}
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	_, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	register := func(zone string) *model.ACMETxt {
+		atxt, err := db.Register(model.CIDRSlice{}, zone)
+		if err != nil {
+			t.Fatalf("Could not initiate db record: [%v]", err)
+		}
+		atxt.Value = "______________valid_response_______________"
+		if err = db.Update(&atxt.ACMETxtPost); err != nil {
+			t.Fatalf("Could not update db record: [%v]", err)
+		}
+		return atxt
+	}
+	root := register("auth.example.org")
+	tenant := register("tenant.auth.example.org")
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for _, test := range []struct {
+		name   string
+		rcode  int
+		answer bool
+	}{
+		{root.Subdomain + ".auth.example.org", dns.RcodeSuccess, true},
+		{tenant.Subdomain + ".tenant.auth.example.org", dns.RcodeSuccess, true},
+		// Accounts are only answered in the zone they were registered in
+		{root.Subdomain + ".tenant.auth.example.org", dns.RcodeNameError, false},
+		{tenant.Subdomain + ".auth.example.org", dns.RcodeNameError, false},
+		// Only directly below the zone apex
+		{root.Subdomain + ".other.auth.example.org", dns.RcodeNameError, false},
+		{"_acme-challenge." + root.Subdomain + ".auth.example.org", dns.RcodeNameError, false},
+		// Names outside of our zones are refused
+		{root.Subdomain + ".example.com", dns.RcodeRefused, false},
+		{root.Subdomain + ".anything.else", dns.RcodeRefused, false},
+	} {
+		answer, _ := resolv.lookup(test.name, dns.TypeTXT)
+		if answer == nil {
+			t.Fatalf("No answer for %s", test.name)
+		}
+		if answer.Rcode != test.rcode {
+			t.Errorf("Expected %s for %s, but got %s", dns.RcodeToString[test.rcode], test.name, dns.RcodeToString[answer.Rcode])
+		}
+		if test.answer {
+			if err := hasExpectedTXTAnswer(answer.Answer, root.Value); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		} else if len(answer.Answer) != 0 {
+			t.Errorf("Expected no answer for %s, but got %v", test.name, answer.Answer)
+		}
+	}
+}
+
+func TestWildcardRecords(t *testing.T) {
+	config := setupConfig()
+	config.StaticRecords = append(append([]string{}, records...),
+		"*.auth.example.org. A 192.0.2.1",
+		"*.auth.example.org. CAA 0 issue \"letsencrypt.org\"",
+		"*.auth.example.org. TXT \"wildcard\"",
+		"sub.auth.example.org. A 192.0.2.2",
+		"*.www.auth.example.org. CNAME www.example.com.",
+	)
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	dnsServer, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________valid_response_______________"
+	if err = db.Update(&atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+	account := atxt.Subdomain + ".auth.example.org."
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for _, test := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"anything.auth.example.org.", dns.TypeA, dns.RcodeSuccess, "192.0.2.1"},
+		{"two.labels.auth.example.org.", dns.TypeA, dns.RcodeSuccess, "192.0.2.1"},
+		{"anything.auth.example.org.", dns.TypeCAA, dns.RcodeSuccess, "letsencrypt.org"},
+		{"anything.auth.example.org.", dns.TypeTXT, dns.RcodeSuccess, "wildcard"},
+		{"host.www.auth.example.org.", dns.TypeA, dns.RcodeSuccess, "www.example.com."},
+		// The wildcard has no MX records
+		{"anything.auth.example.org.", dns.TypeMX, dns.RcodeSuccess, ""},
+		// Names that exist are not covered by the wildcard, nor are the names below them
+		{"sub.auth.example.org.", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"below.sub.auth.example.org.", dns.TypeA, dns.RcodeNameError, ""},
+		{"www.auth.example.org.", dns.TypeA, dns.RcodeSuccess, ""},
+		// Accounts keep their own values
+		{account, dns.TypeTXT, dns.RcodeSuccess, atxt.Value},
+		{account, dns.TypeA, dns.RcodeSuccess, ""},
+		{"_acme-challenge." + account, dns.TypeTXT, dns.RcodeNameError, ""},
+	} {
+		answer, _ := resolv.lookup(test.name, test.qtype)
+		if answer == nil {
+			t.Fatalf("No answer for %s", test.name)
+		}
+		if answer.Rcode != test.rcode {
+			t.Errorf("Expected %s for %s %s, but got %s", dns.RcodeToString[test.rcode], test.name, dns.TypeToString[test.qtype], dns.RcodeToString[answer.Rcode])
+		}
+		if test.answer == "" {
+			if len(answer.Answer) != 0 {
+				t.Errorf("Expected no answer for %s %s, but got %v", test.name, dns.TypeToString[test.qtype], answer.Answer)
+			}
+			continue
+		}
+		if len(answer.Answer) != 1 || answer.Answer[0].Header().Name != test.name || !strings.Contains(answer.Answer[0].String(), test.answer) {
+			t.Errorf("Expected %s answer for %s, but got %v", test.answer, test.name, answer.Answer)
+		}
+	}
+
+	// Denial of existence lists the types of the wildcard
+	types := dnsServer.typesAtName("anything.auth.example.org.")
+	if len(types) != 3 {
+		t.Errorf("Expected the 3 types of the wildcard, but got %v", types)
+	}
+}
+
+func TestIndependentServers(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	var addrs []string
+	for _, domain := range []string{"one.example.org", "two.example.org"} {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Could not listen: [%v]", err)
+		}
+		config := setupConfig()
+		config.Domain = domain
+		config.NSName = "ns1." + domain
+		config.StaticRecords = []string{domain + ". A 127.0.0.1"}
+		dnsServer := NewDNSServerOnPacketConn(logger, nil, conn, domain)
+		dnsServer.ParseRecords(&config)
+		defer startDNSServer(dnsServer)()
+		addrs = append(addrs, conn.LocalAddr().String())
+	}
+
+	for i, domain := range []string{"one.example.org.", "two.example.org."} {
+		m := new(dns.Msg)
+		m.SetQuestion(domain, dns.TypeA)
+		in, err := dns.Exchange(m, addrs[i])
+		if err != nil {
+			t.Fatalf("Error querying the server [%v]", err)
+		}
+		if len(in.Answer) != 1 || in.Answer[0].Header().Name != domain {
+			t.Errorf("Expected server %d to answer for %s, but got %v", i, domain, in.Answer)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	config := setupConfig()
+	config.StaticRecords = nil
+	for i := 0; i < 100; i++ {
+		config.StaticRecords = append(config.StaticRecords, fmt.Sprintf("big.auth.example.org. A 198.51.100.%d", i))
+	}
+	logger := zaptest.NewLogger(t)
+	_, stop := setupDNSServer(config, logger, nil)
+	defer func() { _ = stop() }()
+
+	query := func(net string, udpSize uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("big.auth.example.org.", dns.TypeA)
+		if udpSize > 0 {
+			m.SetEdns0(udpSize, false)
+		}
+		c := &dns.Client{Net: net, UDPSize: dns.MaxMsgSize}
+		in, _, err := c.Exchange(m, "127.0.0.1:15353")
+		if err != nil {
+			t.Fatalf("Error querying the server [%v]", err)
+		}
+		return in
+	}
+
+	for _, test := range []struct {
+		name      string
+		udpSize   uint16
+		maxSize   int
+		truncated bool
+	}{
+		{"no edns", 0, dns.MinMsgSize, true},
+		{"small buffer", 800, 800, true},
+		{"buffer above maximum", 4096, int(DefaultMaxUDPSize), true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			in := query("udp", test.udpSize)
+			if in.Truncated != test.truncated {
+				t.Errorf("Expected TC to be %t, but got %t", test.truncated, in.Truncated)
+			}
+			// The answer was sent compressed
+			in.Compress = true
+			if in.Len() > test.maxSize {
+				t.Errorf("Expected answer of at most %d bytes, but got %d", test.maxSize, in.Len())
+			}
+			if len(in.Answer) == 0 {
+				t.Errorf("Expected truncated answer to keep the records that fit")
+			}
+			if opt := in.IsEdns0(); test.udpSize > 0 && (opt == nil || opt.UDPSize() != DefaultMaxUDPSize) {
+				t.Errorf("Expected answer to advertise UDP size %d, but got %v", DefaultMaxUDPSize, opt)
+			}
+		})
+	}
+
+	// Everything fits if the maximum is raised
+	_ = stop()
+	config.MaxUDPSize = 4096
+	_, stop = setupDNSServer(config, logger, nil)
+	if in := query("udp", 4096); in.Truncated || len(in.Answer) != 100 {
+		t.Errorf("Expected full answer with a large buffer, but got %d records with TC %t", len(in.Answer), in.Truncated)
+	}
+}
+
+func TestNoTruncationOverTCP(t *testing.T) {
+	config := setupConfig()
+	config.Proto = "tcp"
+	config.StaticRecords = nil
+	for i := 0; i < 100; i++ {
+		config.StaticRecords = append(config.StaticRecords, fmt.Sprintf("big.auth.example.org. A 198.51.100.%d", i))
+	}
+	logger := zaptest.NewLogger(t)
+	_, stop := setupDNSServer(config, logger, nil)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("big.auth.example.org.", dns.TypeA)
+	c := &dns.Client{Net: "tcp"}
+	in, _, err := c.Exchange(m, "127.0.0.1:15353")
+	if err != nil {
+		t.Fatalf("Error querying the server [%v]", err)
+	}
+	if in.Truncated || len(in.Answer) != 100 {
+		t.Errorf("Expected full answer over TCP, but got %d records with TC %t", len(in.Answer), in.Truncated)
+	}
+}
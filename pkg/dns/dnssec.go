@@ -0,0 +1,282 @@
+package dns
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Validity of the online signatures. The inception is backdated to allow for
+// clock skew between us and the validators.
+const (
+	sigInceptionOffset = time.Hour
+	sigValidity        = 7 * 24 * time.Hour
+)
+
+// ZoneSigner signs the RRsets of a zone with its DNSSEC keys
+type ZoneSigner struct {
+	zone    string
+	ksks    []signingKey
+	zsks    []signingKey
+	DNSKEYs []dns.RR
+}
+
+type signingKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	tag  uint16
+}
+
+// LoadZoneSigner reads BIND style key pairs for the zone. Each path names a pair of
+// .key and .private files, with or without the extension. Keys with the SEP flag
+// sign the DNSKEY RRset, the others sign everything else. If only one kind of key
+// is given, it is used as a combined signing key.
+func LoadZoneSigner(zone string, paths []string) (*ZoneSigner, error) {
+	s := &ZoneSigner{zone: dns.Fqdn(strings.ToLower(zone))}
+	for _, path := range paths {
+		k, err := readKeyPair(strings.TrimSuffix(strings.TrimSuffix(path, ".key"), ".private"))
+		if err != nil {
+			return nil, err
+		}
+		if strings.ToLower(k.key.Hdr.Name) != s.zone {
+			return nil, fmt.Errorf("Key %s belongs to %s, not to zone %s", path, k.key.Hdr.Name, s.zone)
+		}
+		if k.key.Flags&dns.SEP != 0 {
+			s.ksks = append(s.ksks, k)
+		} else {
+			s.zsks = append(s.zsks, k)
+		}
+		s.DNSKEYs = append(s.DNSKEYs, k.key)
+	}
+	if len(s.DNSKEYs) == 0 {
+		return nil, errors.New("No keys given")
+	}
+	if len(s.zsks) == 0 {
+		s.zsks = s.ksks
+	}
+	if len(s.ksks) == 0 {
+		s.ksks = s.zsks
+	}
+	return s, nil
+}
+
+func readKeyPair(base string) (signingKey, error) {
+	f, err := os.Open(base + ".key")
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, base+".key")
+	if err != nil {
+		return signingKey{}, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s.key does not contain a DNSKEY record", base)
+	}
+	key.Hdr.Name = strings.ToLower(key.Hdr.Name)
+
+	pf, err := os.Open(base + ".private")
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer pf.Close()
+	priv, err := key.ReadPrivateKey(pf, base+".private")
+	if err != nil {
+		return signingKey{}, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s.private does not contain a usable private key", base)
+	}
+	return signingKey{key, signer, key.KeyTag()}, nil
+}
+
+// Sign returns the signatures over an RRset. The DNSKEY RRset is signed with the
+// key signing keys, everything else with the zone signing keys.
+func (s *ZoneSigner) Sign(rrset []dns.RR, now time.Time) ([]dns.RR, error) {
+	keys := s.zsks
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		keys = s.ksks
+	}
+	var sigs []dns.RR
+	for _, k := range keys {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.key.Algorithm,
+			KeyTag:     k.tag,
+			SignerName: s.zone,
+			Inception:  uint32(now.Add(-sigInceptionOffset).Unix()),
+			Expiration: uint32(now.Add(sigValidity).Unix()),
+		}
+		if err := sig.Sign(k.priv, rrset); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// LoadDNSSECKeys loads the keys of every zone that has them configured, which
+// enables online signing for the zone. The DNSKEY records are served at the apex.
+func (d *DNSServer) LoadDNSSECKeys(config *Config) error {
+	z := d.zone().clone()
+	if err := d.loadSigners(z, config); err != nil {
+		return err
+	}
+	d.zones.store(z)
+	return nil
+}
+
+func (d *DNSServer) loadSigners(z *zoneData, config *Config) error {
+	for _, zone := range config.AllZones() {
+		if len(zone.DNSSECKeys) == 0 {
+			continue
+		}
+		signer, err := LoadZoneSigner(zone.Domain, zone.DNSSECKeys)
+		if err != nil {
+			return fmt.Errorf("While loading DNSSEC keys for zone %s: %w", zone.Domain, err)
+		}
+		for _, k := range signer.DNSKEYs {
+			d.appendRR(z, k)
+		}
+		z.signers[signer.zone] = signer
+		d.logger.Info("Signing zone", zap.String("zone", signer.zone), zap.Int("keys", len(signer.DNSKEYs)))
+	}
+	return nil
+}
+
+// signResponse adds denial of existence records and signatures to the answer for
+// a client that set the DO bit. Denial uses minimally covering NSEC records ("black
+// lies"), so NXDOMAIN is answered as NODATA with an NSEC showing no types at the name.
+// The name is the one the answer is for, as returned by readQuery.
+func (d *DNSServer) signResponse(m *dns.Msg, name string) {
+	if len(m.Question) == 0 || !m.MsgHdr.Authoritative {
+		return
+	}
+	q := m.Question[0]
+	zone, ok := d.findZone(q.Name)
+	if !ok || d.zone().signers[zone] == nil {
+		return
+	}
+	if m.MsgHdr.Rcode == dns.RcodeNameError || (m.MsgHdr.Rcode == dns.RcodeSuccess && !ownsRecord(m.Answer, name)) {
+		m.Ns = append(m.Ns, d.denialNSEC(name, m.MsgHdr.Rcode == dns.RcodeNameError))
+		m.MsgHdr.Rcode = dns.RcodeSuccess
+	}
+	now := time.Now()
+	m.Answer = d.signSection(m.Answer, now)
+	m.Ns = d.signSection(m.Ns, now)
+	// The OPT record is not signed, but has to stay
+	opt := m.IsEdns0()
+	m.Extra = d.signSection(m.Extra, now)
+	if opt != nil {
+		m.Extra = append(m.Extra, opt)
+	}
+}
+
+// denialNSEC creates an NSEC record at the name covering only the name itself
+func (d *DNSServer) denialNSEC(name string, nxdomain bool) dns.RR {
+	name = strings.ToLower(name)
+	ttl := DefaultSOAMinimum
+	if soa, ok := d.zoneSOA(name).(*dns.SOA); ok {
+		// RFC 9077: the negative TTL is the smaller of the SOA TTL and minimum
+		ttl = soa.Minttl
+		if soa.Hdr.Ttl < ttl {
+			ttl = soa.Hdr.Ttl
+		}
+	}
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	if !nxdomain {
+		types = append(types, d.typesAtName(name)...)
+	}
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: sortedTypes(types),
+	}
+}
+
+// typesAtName returns the record types that exist at a name
+func (d *DNSServer) typesAtName(name string) []uint16 {
+	var types []uint16
+	if domain, ok := d.zone().domains[name]; ok {
+		for _, rr := range domain.Records {
+			types = append(types, rr.Header().Rrtype)
+		}
+	}
+	if d.isOwnChallenge(name) {
+		types = append(types, dns.TypeTXT)
+	} else if txt, err := d.answerTXT(dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassINET}); err == nil && len(txt) > 0 {
+		// Accounts without a value, eg. new, cleared or expired ones, have no TXT records
+		types = append(types, dns.TypeTXT)
+	}
+	if len(types) == 0 && !d.nameExists(name) {
+		if source, ok := d.wildcardSource(name); ok {
+			for _, rr := range d.zone().domains[source].Records {
+				types = append(types, rr.Header().Rrtype)
+			}
+		}
+	}
+	return types
+}
+
+// signSection appends the signatures of each RRset in the section that belongs to
+// a signed zone
+func (d *DNSServer) signSection(rrs []dns.RR, now time.Time) []dns.RR {
+	signers := d.zone().signers
+	var signed []dns.RR
+	for _, rrset := range splitRRsets(rrs) {
+		signed = append(signed, rrset...)
+		zone, ok := d.findZone(rrset[0].Header().Name)
+		if !ok || signers[zone] == nil {
+			continue
+		}
+		sigs, err := signers[zone].Sign(rrset, now)
+		if err != nil {
+			d.logger.Error("While signing RRset", zap.Error(err), zap.String("name", rrset[0].Header().Name))
+			continue
+		}
+		signed = append(signed, sigs...)
+	}
+	return signed
+}
+
+// splitRRsets groups the records by owner name, class and type, keeping the order
+// in which the RRsets first appear
+func splitRRsets(rrs []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d/%d", strings.ToLower(h.Name), h.Class, h.Rrtype)
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// sortedTypes sorts and deduplicates a list of record types, as needed for an NSEC type bitmap
+func sortedTypes(types []uint16) []uint16 {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	var uniq []uint16
+	for i, t := range types {
+		if i == 0 || t != types[i-1] {
+			uniq = append(uniq, t)
+		}
+	}
+	return uniq
+}
@@ -0,0 +1,225 @@
+package dns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+// writeKeyPair generates a key for the zone and writes it out in BIND format,
+// returning the path without extension
+func writeKeyPair(t *testing.T, dir string, zone string, flags uint16) (string, *dns.DNSKEY) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Could not generate key: [%v]", err)
+	}
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", key.Hdr.Name, key.Algorithm, key.KeyTag()))
+	if err = os.WriteFile(base+".key", []byte(key.String()+"\n"), 0600); err != nil {
+		t.Fatalf("Could not write key: [%v]", err)
+	}
+	if err = os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		t.Fatalf("Could not write private key: [%v]", err)
+	}
+	return base, key
+}
+
+func lookupDO(t *testing.T, name string, qtype uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(4096, true)
+	in, err := dns.Exchange(msg, "127.0.0.1:15353")
+	if err != nil {
+		t.Fatalf("Error querying the server [%v]", err)
+	}
+	return in
+}
+
+// verifySection checks that every RRset in the section is covered by a valid signature
+func verifySection(t *testing.T, rrs []dns.RR, keys map[uint16]*dns.DNSKEY) {
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+		}
+	}
+	for _, rrset := range splitRRsets(rrs) {
+		verified := false
+		for _, sig := range sigs {
+			if sig.TypeCovered != rrset[0].Header().Rrtype || sig.Hdr.Name != rrset[0].Header().Name {
+				continue
+			}
+			key, ok := keys[sig.KeyTag]
+			if !ok {
+				t.Errorf("Signature over %s made with unknown key %d", rrset[0].Header().Name, sig.KeyTag)
+				continue
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				t.Errorf("Signature over %s does not verify: [%v]", rrset[0], err)
+				continue
+			}
+			verified = true
+		}
+		if !verified {
+			t.Errorf("No valid signature for RRset [%s]", rrset[0])
+		}
+	}
+}
+
+func TestDNSSEC(t *testing.T) {
+	dir := t.TempDir()
+	kskPath, ksk := writeKeyPair(t, dir, "auth.example.org", 257)
+	zskPath, zsk := writeKeyPair(t, dir, "auth.example.org", 256)
+	keys := map[uint16]*dns.DNSKEY{ksk.KeyTag(): ksk, zsk.KeyTag(): zsk}
+
+	config := setupConfig()
+	config.DNSSECKeys = []string{kskPath + ".key", zskPath}
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	dnsServer := NewDNSServer(logger, db, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	if err := dnsServer.LoadDNSSECKeys(&config); err != nil {
+		t.Fatalf("Could not load DNSSEC keys: [%v]", err)
+	}
+	stop := startDNSServer(dnsServer)
+	defer stop()
+
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________valid_response_______________"
+	if err = db.Update(&atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+
+	t.Run("DNSKEY", func(t *testing.T) {
+		in := lookupDO(t, "auth.example.org", dns.TypeDNSKEY)
+		if len(in.Answer) != 3 {
+			t.Fatalf("Expected two DNSKEYs and a signature, but got %v", in.Answer)
+		}
+		// The DNSKEY RRset is signed by the KSK only
+		for _, rr := range in.Answer {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.KeyTag != ksk.KeyTag() {
+				t.Errorf("Expected DNSKEY RRset to be signed with the KSK, but got key %d", sig.KeyTag)
+			}
+		}
+		verifySection(t, in.Answer, keys)
+	})
+
+	t.Run("dynamic TXT", func(t *testing.T) {
+		in := lookupDO(t, atxt.Subdomain+".auth.example.org", dns.TypeTXT)
+		if len(in.Answer) != 2 {
+			t.Fatalf("Expected TXT and signature, but got %v", in.Answer)
+		}
+		verifySection(t, in.Answer, keys)
+	})
+
+	t.Run("NXDOMAIN", func(t *testing.T) {
+		in := lookupDO(t, "nonexistent.auth.example.org", dns.TypeA)
+		if in.Rcode != dns.RcodeSuccess {
+			t.Errorf("Expected NXDOMAIN to be answered as NODATA, but got [%s]", dns.RcodeToString[in.Rcode])
+		}
+		var nsec *dns.NSEC
+		for _, rr := range in.Ns {
+			if n, ok := rr.(*dns.NSEC); ok {
+				nsec = n
+			}
+		}
+		if nsec == nil || nsec.NextDomain != "\\000.nonexistent.auth.example.org." {
+			t.Fatalf("Expected covering NSEC in authority section, but got %v", in.Ns)
+		}
+		if len(nsec.TypeBitMap) != 2 {
+			t.Errorf("Expected only RRSIG and NSEC in the type bitmap, but got %v", nsec.TypeBitMap)
+		}
+		verifySection(t, in.Ns, keys)
+	})
+
+	t.Run("NODATA", func(t *testing.T) {
+		in := lookupDO(t, atxt.Subdomain+".auth.example.org", dns.TypeA)
+		var nsec *dns.NSEC
+		for _, rr := range in.Ns {
+			if n, ok := rr.(*dns.NSEC); ok {
+				nsec = n
+			}
+		}
+		if nsec == nil {
+			t.Fatalf("Expected NSEC in authority section, but got %v", in.Ns)
+		}
+		hasTXT := false
+		for _, typ := range nsec.TypeBitMap {
+			if typ == dns.TypeTXT {
+				hasTXT = true
+			}
+		}
+		if !hasTXT {
+			t.Errorf("Expected TXT in the type bitmap for an account, but got %v", nsec.TypeBitMap)
+		}
+		verifySection(t, in.Ns, keys)
+	})
+
+	t.Run("NODATA at empty account", func(t *testing.T) {
+		empty, err := db.Register(model.CIDRSlice{}, "")
+		if err != nil {
+			t.Fatalf("Could not initiate db record: [%v]", err)
+		}
+		in := lookupDO(t, empty.Subdomain+".auth.example.org", dns.TypeTXT)
+		if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+			t.Fatalf("Expected NODATA for an account without a value, but got %v", in)
+		}
+		var nsec *dns.NSEC
+		for _, rr := range in.Ns {
+			if n, ok := rr.(*dns.NSEC); ok {
+				nsec = n
+			}
+		}
+		if nsec == nil {
+			t.Fatalf("Expected NSEC in authority section, but got %v", in.Ns)
+		}
+		// Listing TXT would make validators reject the denial
+		for _, typ := range nsec.TypeBitMap {
+			if typ == dns.TypeTXT {
+				t.Errorf("Expected no TXT in the type bitmap without a value, but got %v", nsec.TypeBitMap)
+			}
+		}
+		verifySection(t, in.Ns, keys)
+	})
+
+	t.Run("without DO", func(t *testing.T) {
+		resolv := resolver{server: "127.0.0.1:15353"}
+		in, err := resolv.lookup("auth.example.org", dns.TypeA)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		for _, rr := range in.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				t.Errorf("Did not expect signatures without the DO bit")
+			}
+		}
+	})
+}
+
+func TestLoadZoneSignerErrors(t *testing.T) {
+	dir := t.TempDir()
+	path, _ := writeKeyPair(t, dir, "other.example.org", 257)
+
+	if _, err := LoadZoneSigner("auth.example.org", []string{path}); err == nil {
+		t.Errorf("Expected error for key of another zone, but got none")
+	}
+	if _, err := LoadZoneSigner("auth.example.org", []string{filepath.Join(dir, "missing")}); err == nil {
+		t.Errorf("Expected error for missing key, but got none")
+	}
+	if _, err := LoadZoneSigner("auth.example.org", nil); err == nil {
+		t.Errorf("Expected error without keys, but got none")
+	}
+}
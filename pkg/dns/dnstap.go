@@ -0,0 +1,446 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Frame Streams constants, see https://farsightsec.github.io/fstrm/
+const (
+	fstrmContentType    = "protobuf:dnstap.Dnstap"
+	fstrmControlAccept  = 1
+	fstrmControlStart   = 2
+	fstrmControlStop    = 3
+	fstrmControlReady   = 4
+	fstrmControlFinish  = 5
+	fstrmFieldType      = 1
+	fstrmMaxControlSize = 512
+)
+
+// Field numbers and enum values of dnstap.proto
+const (
+	dnstapFieldIdentity = 1
+	dnstapFieldVersion  = 2
+	dnstapFieldMessage  = 14
+	dnstapFieldType     = 15
+	dnstapTypeMessage   = 1
+
+	dnstapMessageType             = 1
+	dnstapMessageSocketFamily     = 2
+	dnstapMessageSocketProtocol   = 3
+	dnstapMessageQueryAddress     = 4
+	dnstapMessageResponseAddress  = 5
+	dnstapMessageQueryPort        = 6
+	dnstapMessageResponsePort     = 7
+	dnstapMessageQueryTimeSec     = 8
+	dnstapMessageQueryTimeNsec    = 9
+	dnstapMessageQueryMessage     = 10
+	dnstapMessageResponseTimeSec  = 12
+	dnstapMessageResponseTimeNsec = 13
+	dnstapMessageResponseMessage  = 14
+
+	dnstapAuthQuery    = 1
+	dnstapAuthResponse = 2
+
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+	dnstapProtocolDOT = 3
+	dnstapProtocolDOH = 4
+)
+
+// Output buffering and reconnection policy
+const (
+	dnstapQueueSize  = 1024
+	dnstapRetry      = time.Second
+	dnstapTimeout    = 5 * time.Second
+	dnstapVersion    = "dnsacmed"
+	dnstapBufferSize = 64 * 1024
+)
+
+// dnstapDropped counts the messages lost because the output could not keep up or
+// was unavailable, published with expvar
+var dnstapDropped = expvar.NewInt("dns_dnstap_dropped")
+
+// Dnstap writes the queries received and the responses sent in dnstap format, to a
+// file or to a collector listening on a Unix socket. Messages are written in the
+// background, and dropped rather than delaying answers if the output falls behind.
+type Dnstap struct {
+	logger   *zap.Logger
+	identity []byte
+	socket   string
+	file     string
+	enabled  int32
+	sample   uint32
+	count    uint32
+	frames   chan []byte
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewDnstap opens the dnstap output of the config and starts writing to it until
+// Close is called. A collector that is not listening yet is retried later.
+func NewDnstap(logger *zap.Logger, config *Config) (*Dnstap, error) {
+	t := &Dnstap{
+		logger:  logger,
+		socket:  config.Dnstap.Socket,
+		file:    config.Dnstap.File,
+		frames:  make(chan []byte, dnstapQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	t.identity = []byte(config.Dnstap.Identity)
+	if len(t.identity) == 0 {
+		hostname, _ := os.Hostname()
+		t.identity = []byte(hostname)
+	}
+	t.Configure(config)
+	var out *frameStream
+	if t.file != "" {
+		var err error
+		if out, err = t.open(); err != nil {
+			return nil, err
+		}
+	}
+	go t.run(out)
+	return t, nil
+}
+
+// Configure applies the options that can be changed while running: whether messages
+// are written at all, and the sampling rate
+func (t *Dnstap) Configure(config *Config) {
+	var enabled int32
+	if config.Dnstap.Enabled {
+		enabled = 1
+	}
+	atomic.StoreInt32(&t.enabled, enabled)
+	atomic.StoreUint32(&t.sample, uint32(config.Dnstap.Sample))
+}
+
+// Close writes out the queued messages and closes the output
+func (t *Dnstap) Close() {
+	close(t.done)
+	<-t.stopped
+}
+
+// sampled reports whether the next query and its response should be written
+func (t *Dnstap) sampled() bool {
+	if atomic.LoadInt32(&t.enabled) == 0 {
+		return false
+	}
+	sample := atomic.LoadUint32(&t.sample)
+	return sample <= 1 || atomic.AddUint32(&t.count, 1)%sample == 0
+}
+
+// wrap writes out the query if it is sampled, and returns a response writer that
+// writes out the responses to it
+func (t *Dnstap) wrap(w dns.ResponseWriter, r *dns.Msg, protocol uint64) dns.ResponseWriter {
+	if !t.sampled() {
+		return w
+	}
+	tw := &dnstapResponseWriter{ResponseWriter: w, tap: t, protocol: protocol, queryTime: time.Now()}
+	if buf, err := r.Pack(); err == nil {
+		tw.query = buf
+	}
+	t.send(tw.message(dnstapAuthQuery, nil, time.Time{}))
+	return tw
+}
+
+func (t *Dnstap) send(frame []byte) {
+	select {
+	case t.frames <- frame:
+	default:
+		dnstapDropped.Add(1)
+	}
+}
+
+func (t *Dnstap) run(out *frameStream) {
+	defer close(t.stopped)
+	var failed time.Time
+	write := func(frame []byte) {
+		// A file is only opened once, as opening it again would truncate it
+		if out == nil && t.socket != "" && time.Since(failed) > dnstapRetry {
+			var err error
+			if out, err = t.open(); err != nil {
+				t.logger.Warn("Could not open dnstap output", zap.Error(err))
+				failed = time.Now()
+			}
+		}
+		if out == nil {
+			dnstapDropped.Add(1)
+			return
+		}
+		err := out.writeFrame(frame)
+		if err == nil && len(t.frames) == 0 {
+			// Flush once the queue is empty, so messages are not held back
+			err = out.w.Flush()
+		}
+		if err != nil {
+			t.logger.Warn("Could not write dnstap message", zap.Error(err))
+			dnstapDropped.Add(1)
+			out.conn.Close()
+			out = nil
+			failed = time.Now()
+		}
+	}
+	for {
+		select {
+		case frame := <-t.frames:
+			write(frame)
+		case <-t.done:
+			for len(t.frames) > 0 {
+				write(<-t.frames)
+			}
+			if out != nil {
+				if err := out.finish(); err != nil {
+					t.logger.Warn("Could not close dnstap output", zap.Error(err))
+				}
+			}
+			return
+		}
+	}
+}
+
+func (t *Dnstap) open() (*frameStream, error) {
+	if t.file != "" {
+		f, err := os.OpenFile(t.file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("While opening dnstap file: %w", err)
+		}
+		return openFrameStream(f, false)
+	}
+	conn, err := net.DialTimeout("unix", t.socket, dnstapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return openFrameStream(conn, true)
+}
+
+// dnstapResponseWriter writes out the responses to a sampled query
+type dnstapResponseWriter struct {
+	dns.ResponseWriter
+	tap       *Dnstap
+	protocol  uint64
+	query     []byte
+	queryTime time.Time
+}
+
+func (w *dnstapResponseWriter) WriteMsg(m *dns.Msg) error {
+	err := w.ResponseWriter.WriteMsg(m)
+	if err == nil {
+		if buf, err := m.Pack(); err == nil {
+			w.tap.send(w.message(dnstapAuthResponse, buf, time.Now()))
+		}
+	}
+	return err
+}
+
+// message encodes a Dnstap protobuf frame for the query or a response to it
+func (w *dnstapResponseWriter) message(typ uint64, response []byte, responseTime time.Time) []byte {
+	var msg protobuf
+	msg.varint(dnstapMessageType, typ)
+	clientIP, clientPort := addrIPPort(w.RemoteAddr())
+	serverIP, serverPort := addrIPPort(w.LocalAddr())
+	if ip4 := clientIP.To4(); ip4 != nil {
+		msg.varint(dnstapMessageSocketFamily, dnstapFamilyINET)
+		clientIP = ip4
+		serverIP = serverIP.To4()
+	} else if clientIP != nil {
+		msg.varint(dnstapMessageSocketFamily, dnstapFamilyINET6)
+	}
+	msg.varint(dnstapMessageSocketProtocol, w.protocol)
+	if clientIP != nil {
+		msg.bytes(dnstapMessageQueryAddress, clientIP)
+		msg.varint(dnstapMessageQueryPort, uint64(clientPort))
+	}
+	if serverIP != nil {
+		msg.bytes(dnstapMessageResponseAddress, serverIP)
+		msg.varint(dnstapMessageResponsePort, uint64(serverPort))
+	}
+	msg.varint(dnstapMessageQueryTimeSec, uint64(w.queryTime.Unix()))
+	msg.fixed32(dnstapMessageQueryTimeNsec, uint32(w.queryTime.Nanosecond()))
+	if typ == dnstapAuthQuery {
+		if w.query != nil {
+			msg.bytes(dnstapMessageQueryMessage, w.query)
+		}
+	} else {
+		msg.varint(dnstapMessageResponseTimeSec, uint64(responseTime.Unix()))
+		msg.fixed32(dnstapMessageResponseTimeNsec, uint32(responseTime.Nanosecond()))
+		msg.bytes(dnstapMessageResponseMessage, response)
+	}
+
+	var frame protobuf
+	frame.bytes(dnstapFieldIdentity, w.tap.identity)
+	frame.bytes(dnstapFieldVersion, []byte(dnstapVersion))
+	frame.bytes(dnstapFieldMessage, msg)
+	frame.varint(dnstapFieldType, dnstapTypeMessage)
+	return frame
+}
+
+// socketProtocol returns the dnstap transport of a query
+func (d *DNSServer) socketProtocol(w dns.ResponseWriter) uint64 {
+	if _, ok := w.(*dohResponseWriter); ok {
+		return dnstapProtocolDOH
+	}
+	if strings.HasSuffix(d.Server.Net, "-tls") {
+		return dnstapProtocolDOT
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return dnstapProtocolUDP
+	}
+	return dnstapProtocolTCP
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// protobuf encodes the few protocol buffer wire types dnstap needs
+type protobuf []byte
+
+func (p *protobuf) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*p = append(*p, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (p *protobuf) varint(field int, v uint64) {
+	p.uvarint(uint64(field) << 3)
+	p.uvarint(v)
+}
+
+func (p *protobuf) bytes(field int, v []byte) {
+	p.uvarint(uint64(field)<<3 | 2)
+	p.uvarint(uint64(len(v)))
+	*p = append(*p, v...)
+}
+
+func (p *protobuf) fixed32(field int, v uint32) {
+	p.uvarint(uint64(field)<<3 | 5)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	*p = append(*p, buf[:]...)
+}
+
+// frameStream is the writing end of a Frame Streams connection. Connections to a
+// collector are bidirectional, files are unidirectional.
+type frameStream struct {
+	conn          io.ReadWriteCloser
+	w             *bufio.Writer
+	bidirectional bool
+}
+
+func openFrameStream(conn io.ReadWriteCloser, bidirectional bool) (*frameStream, error) {
+	s := &frameStream{conn: conn, w: bufio.NewWriterSize(conn, dnstapBufferSize), bidirectional: bidirectional}
+	if bidirectional {
+		if err := s.handshake(fstrmControlReady, fstrmControlAccept); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := s.writeControl(fstrmControlStart); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// handshake sends a control frame and waits for the expected reply
+func (s *frameStream) handshake(send uint32, expect uint32) error {
+	if err := s.writeControl(send); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if conn, ok := s.conn.(net.Conn); ok {
+		_ = conn.SetReadDeadline(time.Now().Add(dnstapTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	typ, err := readControl(s.conn)
+	if err != nil {
+		return err
+	}
+	if typ != expect {
+		return fmt.Errorf("Unexpected Frame Streams control frame %d", typ)
+	}
+	return nil
+}
+
+func (s *frameStream) writeFrame(frame []byte) error {
+	if _, err := s.w.Write(appendUint32(nil, uint32(len(frame)))); err != nil {
+		return err
+	}
+	_, err := s.w.Write(frame)
+	return err
+}
+
+// writeControl writes a control frame. START and READY carry the content type.
+func (s *frameStream) writeControl(typ uint32) error {
+	payload := appendUint32(nil, typ)
+	if typ == fstrmControlStart || typ == fstrmControlReady {
+		payload = appendUint32(payload, fstrmFieldType)
+		payload = appendUint32(payload, uint32(len(fstrmContentType)))
+		payload = append(payload, fstrmContentType...)
+	}
+	// A zero length escapes a control frame
+	header := appendUint32(appendUint32(nil, 0), uint32(len(payload)))
+	if _, err := s.w.Write(header); err != nil {
+		return err
+	}
+	_, err := s.w.Write(payload)
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// finish stops the stream and closes the output
+func (s *frameStream) finish() error {
+	defer s.conn.Close()
+	if s.bidirectional {
+		return s.handshake(fstrmControlStop, fstrmControlFinish)
+	}
+	if err := s.writeControl(fstrmControlStop); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// readControl reads a control frame and returns its type
+func readControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := binary.BigEndian.Uint32(header[4:])
+	if binary.BigEndian.Uint32(header[:4]) != 0 || size < 4 || size > fstrmMaxControlSize {
+		return 0, fmt.Errorf("Invalid Frame Streams control frame")
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
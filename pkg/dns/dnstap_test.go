@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+// readFrames reads a Frame Streams stream up to the STOP frame, returning the data frames
+func readFrames(r io.Reader) ([][]byte, error) {
+	if typ, err := readControl(r); err != nil || typ != fstrmControlStart {
+		return nil, fmt.Errorf("Expected START frame, but got %d [%v]", typ, err)
+	}
+	var frames [][]byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size == 0 {
+			// Put back the escape read above
+			typ, err := readControl(io.MultiReader(bytes.NewReader(header[:]), r))
+			if err != nil || typ != fstrmControlStop {
+				return nil, fmt.Errorf("Expected STOP frame, but got %d [%v]", typ, err)
+			}
+			return frames, nil
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// readFramesFile reads the data frames written to a file
+func readFramesFile(t *testing.T, path string) [][]byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open dnstap file: [%v]", err)
+	}
+	defer f.Close()
+	frames, err := readFrames(bufio.NewReader(f))
+	if err != nil {
+		t.Fatalf("Could not read dnstap file: [%v]", err)
+	}
+	return frames
+}
+
+// decodeProtobuf returns the fields of a protobuf message. Varint and fixed32 values
+// are returned as uint64, length delimited ones as bytes.
+func decodeProtobuf(t *testing.T, b []byte) map[int]interface{} {
+	fields := make(map[int]interface{})
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			fields[int(key>>3)] = v
+			b = b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			fields[int(key>>3)] = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case 5:
+			fields[int(key>>3)] = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("Unexpected protobuf wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// checkDnstapFrames checks that the frames are queries for the name each followed
+// by its response, sent over UDP from localhost
+func checkDnstapFrames(t *testing.T, frames [][]byte, name string) {
+	if len(frames)%2 != 0 {
+		t.Fatalf("Expected queries and responses in pairs, but got %d frames", len(frames))
+	}
+	for i, frame := range frames {
+		tap := decodeProtobuf(t, frame)
+		if tap[dnstapFieldType] != uint64(dnstapTypeMessage) || string(tap[dnstapFieldIdentity].([]byte)) != "test" {
+			t.Errorf("Unexpected dnstap frame %v", tap)
+			continue
+		}
+		msg := decodeProtobuf(t, tap[dnstapFieldMessage].([]byte))
+		typ, field := uint64(dnstapAuthQuery), dnstapMessageQueryMessage
+		if i%2 == 1 {
+			typ, field = dnstapAuthResponse, dnstapMessageResponseMessage
+		}
+		if msg[dnstapMessageType] != typ {
+			t.Errorf("Expected message type %d for frame %d, but got %v", typ, i, msg[dnstapMessageType])
+		}
+		if msg[dnstapMessageSocketProtocol] != uint64(dnstapProtocolUDP) || msg[dnstapMessageSocketFamily] != uint64(dnstapFamilyINET) {
+			t.Errorf("Expected UDP over IPv4, but got %v", msg)
+		}
+		if ip, ok := msg[dnstapMessageQueryAddress].([]byte); !ok || !net.IP(ip).Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("Expected query address 127.0.0.1, but got %v", msg[dnstapMessageQueryAddress])
+		}
+		wire, ok := msg[field].([]byte)
+		if !ok {
+			t.Errorf("Frame %d is missing the DNS message", i)
+			continue
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(wire); err != nil || len(m.Question) != 1 || m.Question[0].Name != name {
+			t.Errorf("Unexpected DNS message in frame %d: %v [%v]", i, m, err)
+		}
+		if i%2 == 1 && len(m.Answer) != 1 {
+			t.Errorf("Expected response with answer, but got %v", m)
+		}
+	}
+}
+
+func setupDnstapServer(t *testing.T, config Config) (*Dnstap, func() error) {
+	logger := zaptest.NewLogger(t)
+	config.Dnstap.Enabled = true
+	config.Dnstap.Identity = "test"
+	tap, err := NewDnstap(logger, &config)
+	if err != nil {
+		t.Fatalf("Could not set up dnstap: [%v]", err)
+	}
+	dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	dnsServer.Dnstap = tap
+	return tap, startDNSServer(dnsServer)
+}
+
+func TestDnstapFile(t *testing.T) {
+	config := setupConfig()
+	config.Dnstap.File = filepath.Join(t.TempDir(), "dnstap.fstrm")
+	tap, stop := setupDnstapServer(t, config)
+	defer stop()
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for i := 0; i < 2; i++ {
+		if _, err := resolv.lookup("ns1.auth.example.org", dns.TypeA); err != nil {
+			t.Fatalf("Unexpected error [%v]", err)
+		}
+	}
+	tap.Close()
+
+	frames := readFramesFile(t, config.Dnstap.File)
+	if len(frames) != 4 {
+		t.Errorf("Expected 4 frames, but got %d", len(frames))
+	}
+	checkDnstapFrames(t, frames, "ns1.auth.example.org.")
+}
+
+func TestDnstapSampling(t *testing.T) {
+	config := setupConfig()
+	config.Dnstap.File = filepath.Join(t.TempDir(), "dnstap.fstrm")
+	config.Dnstap.Sample = 2
+	tap, stop := setupDnstapServer(t, config)
+	defer stop()
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for i := 0; i < 4; i++ {
+		if _, err := resolv.lookup("ns1.auth.example.org", dns.TypeA); err != nil {
+			t.Fatalf("Unexpected error [%v]", err)
+		}
+	}
+	// Nothing is written once disabled
+	config.Dnstap.Enabled = false
+	tap.Configure(&config)
+	for i := 0; i < 4; i++ {
+		if _, err := resolv.lookup("ns1.auth.example.org", dns.TypeA); err != nil {
+			t.Fatalf("Unexpected error [%v]", err)
+		}
+	}
+	tap.Close()
+
+	frames := readFramesFile(t, config.Dnstap.File)
+	if len(frames) != 4 {
+		t.Errorf("Expected 4 frames for every other of 4 queries, but got %d", len(frames))
+	}
+	checkDnstapFrames(t, frames, "ns1.auth.example.org.")
+}
+
+func TestDnstapSocket(t *testing.T) {
+	config := setupConfig()
+	config.Dnstap.Socket = filepath.Join(t.TempDir(), "dnstap.sock")
+	listener, err := net.Listen("unix", config.Dnstap.Socket)
+	if err != nil {
+		t.Fatalf("Could not listen on socket: [%v]", err)
+	}
+	defer listener.Close()
+
+	// The collector accepts one connection and returns the frames received
+	received := make(chan [][]byte, 1)
+	go func() {
+		defer close(received)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := &frameStream{conn: conn, w: bufio.NewWriter(conn)}
+		if typ, err := readControl(conn); err != nil || typ != fstrmControlReady {
+			t.Errorf("Expected READY frame, but got %d [%v]", typ, err)
+			return
+		}
+		if s.writeControl(fstrmControlAccept) != nil || s.w.Flush() != nil {
+			return
+		}
+		frames, err := readFrames(conn)
+		if err != nil {
+			t.Errorf("Could not read frames: [%v]", err)
+			return
+		}
+		if s.writeControl(fstrmControlFinish) != nil || s.w.Flush() != nil {
+			return
+		}
+		received <- frames
+	}()
+
+	tap, stop := setupDnstapServer(t, config)
+	defer stop()
+	resolv := resolver{server: "127.0.0.1:15353"}
+	if _, err := resolv.lookup("ns1.auth.example.org", dns.TypeA); err != nil {
+		t.Fatalf("Unexpected error [%v]", err)
+	}
+	tap.Close()
+
+	frames := <-received
+	if len(frames) != 2 {
+		t.Errorf("Expected 2 frames, but got %d", len(frames))
+	}
+	checkDnstapFrames(t, frames, "ns1.auth.example.org.")
+}
@@ -0,0 +1,206 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// dohPath is the URI path of DNS queries over HTTPS
+const dohPath = "/dns-query"
+
+// dohMediaType is the content type of DNS messages over HTTPS (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+// dohTimeout bounds how long a client may take to send a query or read the answer
+const dohTimeout = 10 * time.Second
+
+// DoHServer answers DNS queries over HTTPS (RFC 8484) with the records of a DNSServer
+type DoHServer struct {
+	logger    *zap.Logger
+	dnsServer *DNSServer
+	network   string
+	Server    *http.Server
+}
+
+// NewDoHServer returns a new DoHServer answering on addr. The network is "tcp",
+// "tcp4" or "tcp6".
+func NewDoHServer(dnsServer *DNSServer, addr string, network string, tlsConfig *tls.Config) *DoHServer {
+	s := &DoHServer{logger: dnsServer.logger, dnsServer: dnsServer, network: network}
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, s)
+	s.Server = &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  dohTimeout,
+		WriteTimeout: dohTimeout,
+	}
+	return s
+}
+
+// Start starts the DoHServer
+func (s *DoHServer) Start(errorChannel chan error) {
+	s.logger.Info("Listening DNS", zap.String("addr", s.Server.Addr), zap.String("proto", "https"))
+	listener, err := net.Listen(s.network, s.Server.Addr)
+	if err == nil {
+		err = s.Server.ServeTLS(listener, "", "")
+	}
+	if err != nil && err != http.ErrServerClosed {
+		errorChannel <- err
+	}
+}
+
+func (s *DoHServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err != nil || len(buf) == 0 || req.Unpack(buf) != nil || req.Response {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{keyring: s.dnsServer.keyring(), local: s.localAddr(r), remote: remoteTCPAddr(r.RemoteAddr)}
+	if req.Opcode == dns.OpcodeQuery && len(req.Question) == 1 &&
+		(req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+		// Zone transfers take several messages, which a single HTTP response can't hold
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		_ = rw.WriteMsg(m)
+	} else {
+		if tsig := req.IsTsig(); tsig != nil {
+			rw.verify(buf, tsig)
+		}
+		s.dnsServer.handleRequest(rw, req)
+	}
+	if rw.reply == nil {
+		// Dropped by the answering logic
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	if ttl, ok := dohMaxAge(rw.msg); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	_, _ = w.Write(rw.reply)
+}
+
+func (s *DoHServer) localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// dohMaxAge returns the lowest TTL of the records in a reply, which is how long the
+// reply may be cached (RFC 8484 section 5.1)
+func dohMaxAge(m *dns.Msg) (uint32, bool) {
+	if m == nil || m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if t := rr.Header().Rrtype; t == dns.TypeOPT || t == dns.TypeTSIG {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+func remoteTCPAddr(addr string) net.Addr {
+	if a, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return a
+	}
+	return &net.TCPAddr{}
+}
+
+// dohResponseWriter collects the reply to a query received over HTTPS
+type dohResponseWriter struct {
+	keyring    tsigKeyring
+	local      net.Addr
+	remote     net.Addr
+	tsigStatus error
+	tsigMAC    string
+	msg        *dns.Msg
+	reply      []byte
+}
+
+// verify checks the TSIG signature of the request, like dns.Server does for its
+// own transports
+func (w *dohResponseWriter) verify(buf []byte, tsig *dns.TSIG) {
+	secret, err := w.keyring.secret(tsig.Hdr.Name)
+	if err == nil {
+		err = dns.TsigVerify(buf, secret, "", false)
+	}
+	w.tsigStatus = err
+	w.tsigMAC = tsig.MAC
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	var buf []byte
+	var err error
+	if tsig := m.IsTsig(); tsig != nil {
+		var secret string
+		if secret, err = w.keyring.secret(tsig.Hdr.Name); err != nil {
+			return err
+		}
+		buf, _, err = dns.TsigGenerate(m, secret, w.tsigMAC, false)
+	} else {
+		buf, err = m.Pack()
+	}
+	if err != nil {
+		return err
+	}
+	w.msg = m
+	w.reply = buf
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.reply = b
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// keyring returns the TSIG keys accepted by the server
+func (d *DNSServer) keyring() tsigKeyring {
+	if k, ok := d.Server.TsigProvider.(tsigKeyring); ok {
+		return k
+	}
+	return tsigKeyring{db: d.DB}
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: [%v]", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "auth.example.org"},
+		DNSNames:     []string{"auth.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: [%v]", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func dohRequest(t *testing.T, s *DoHServer, method string, m *dns.Msg, contentType string) *httptest.ResponseRecorder {
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Could not pack query: [%v]", err)
+	}
+	var r *http.Request
+	if method == http.MethodGet {
+		r = httptest.NewRequest(method, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		r = httptest.NewRequest(method, dohPath, bytes.NewReader(buf))
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	s.Server.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestDoH(t *testing.T) {
+	config := setupConfig()
+	logger := zaptest.NewLogger(t)
+	dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	s := NewDoHServer(dnsServer, "127.0.0.1:0", "tcp", selfSignedTLSConfig(t))
+
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeA)
+	m.Id = 0
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := dohRequest(t, s, method, m, dohMediaType)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, but got %d", method, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != dohMediaType {
+			t.Errorf("Expected content type %s, but got %s", dohMediaType, ct)
+		}
+		in := new(dns.Msg)
+		if err := in.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatalf("Could not unpack answer: [%v]", err)
+		}
+		if len(in.Answer) != 1 || !in.Authoritative {
+			t.Errorf("Expected authoritative answer for %s, but got %v", method, in)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "max-age=3600" {
+			t.Errorf("Expected Cache-Control from record TTL, but got [%s]", cc)
+		}
+	}
+
+	if w := dohRequest(t, s, http.MethodPost, m, "text/plain"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status 415 for wrong content type, but got %d", w.Code)
+	}
+	if w := dohRequest(t, s, http.MethodPut, m, dohMediaType); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for PUT, but got %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, dohPath+"?dns=!!!", nil)
+	w := httptest.NewRecorder()
+	s.Server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for malformed query, but got %d", w.Code)
+	}
+
+	m = new(dns.Msg)
+	m.SetAxfr("auth.example.org.")
+	in := new(dns.Msg)
+	if err := in.Unpack(dohRequest(t, s, http.MethodPost, m, dohMediaType).Body.Bytes()); err != nil || in.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected zone transfer over HTTPS to be refused, but got %v with error [%v]", in, err)
+	}
+}
+
+func TestDoT(t *testing.T) {
+	config := setupConfig()
+	logger := zaptest.NewLogger(t)
+	dnsServer := NewDNSServer(logger, nil, config.Listen, "tcp-tls", config.Domain)
+	dnsServer.Server.TLSConfig = selfSignedTLSConfig(t)
+	dnsServer.ParseRecords(&config)
+	defer startDNSServer(dnsServer)()
+
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeA)
+	in, _, err := c.Exchange(m, "127.0.0.1:15353")
+	if err != nil {
+		t.Fatalf("Error querying the server over TLS [%v]", err)
+	}
+	if len(in.Answer) != 1 {
+		t.Errorf("Expected one answer over TLS, but got %v", in.Answer)
+	}
+}
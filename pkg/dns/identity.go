@@ -0,0 +1,82 @@
+package dns
+
+import (
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultVersion is answered to version queries unless configured otherwise
+const DefaultVersion = "dnsacmed"
+
+// identityTTL is the TTL of the CHAOS TXT records
+const identityTTL = 0
+
+// serverIdentity answers the CHAOS class queries identifying the server and adds the
+// NSID option (RFC 5001) to the replies of clients asking for it
+type serverIdentity struct {
+	id          string
+	version     string
+	hideVersion bool
+}
+
+// ConfigureIdentity sets up the server id and version answered to id.server,
+// hostname.bind and version.bind queries. The server id defaults to the hostname.
+func (d *DNSServer) ConfigureIdentity(config *Config) {
+	identity := &serverIdentity{
+		id:          config.Identity.ServerID,
+		version:     config.Identity.Version,
+		hideVersion: config.Identity.HideVersion,
+	}
+	if identity.id == "" {
+		identity.id, _ = os.Hostname()
+	}
+	if identity.version == "" {
+		identity.version = DefaultVersion
+	}
+	d.identity = identity
+}
+
+// answerChaos answers CHAOS class TXT queries for the server id and version. Other
+// names are refused, as is everything if no identity is configured.
+func (d *DNSServer) answerChaos(q dns.Question) ([]dns.RR, int, bool) {
+	if d.identity == nil {
+		return nil, dns.RcodeRefused, false
+	}
+	var value string
+	switch strings.ToLower(q.Name) {
+	case "id.server.", "hostname.bind.":
+		value = d.identity.id
+	case "version.server.", "version.bind.":
+		if d.identity.hideVersion {
+			return nil, dns.RcodeRefused, false
+		}
+		value = d.identity.version
+	default:
+		return nil, dns.RcodeRefused, false
+	}
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		return nil, dns.RcodeSuccess, false
+	}
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: identityTTL},
+		Txt: []string{value},
+	}
+	return []dns.RR{txt}, dns.RcodeSuccess, true
+}
+
+// addNSID adds the server id to a reply if the request asked for it
+func (d *DNSServer) addNSID(m *dns.Msg, request *dns.OPT) {
+	opt := m.IsEdns0()
+	if d.identity == nil || opt == nil {
+		return
+	}
+	for _, o := range request.Option {
+		if _, ok := o.(*dns.EDNS0_NSID); ok {
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(d.identity.id))})
+			return
+		}
+	}
+}
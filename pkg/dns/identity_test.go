@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestChaosIdentity(t *testing.T) {
+	config := setupConfig()
+	config.Identity.ServerID = "node1.example.org"
+	logger := zaptest.NewLogger(t)
+	dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	dnsServer.ConfigureIdentity(&config)
+	defer startDNSServer(dnsServer)()
+
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+		value string
+	}{
+		{"id.server.", dns.TypeTXT, dns.RcodeSuccess, "node1.example.org"},
+		{"HOSTNAME.bind.", dns.TypeTXT, dns.RcodeSuccess, "node1.example.org"},
+		{"version.bind.", dns.TypeTXT, dns.RcodeSuccess, DefaultVersion},
+		{"version.server.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"authors.bind.", dns.TypeTXT, dns.RcodeRefused, ""},
+		{"auth.example.org.", dns.TypeTXT, dns.RcodeRefused, ""},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, test.qtype)
+		m.Question[0].Qclass = dns.ClassCHAOS
+		in, err := dns.Exchange(m, "127.0.0.1:15353")
+		if err != nil {
+			t.Fatalf("Unexpected error [%v]", err)
+		}
+		if in.Rcode != test.rcode {
+			t.Errorf("Expected %s for %s, but got %s", dns.RcodeToString[test.rcode], test.name, dns.RcodeToString[in.Rcode])
+		}
+		if test.value == "" {
+			if len(in.Answer) != 0 {
+				t.Errorf("Expected no answer for %s, but got %v", test.name, in.Answer)
+			}
+			continue
+		}
+		if len(in.Answer) != 1 {
+			t.Errorf("Expected one answer for %s, but got %v", test.name, in.Answer)
+			continue
+		}
+		if txt, ok := in.Answer[0].(*dns.TXT); !ok || txt.Hdr.Class != dns.ClassCHAOS || len(txt.Txt) != 1 || txt.Txt[0] != test.value {
+			t.Errorf("Expected CHAOS TXT %q for %s, but got %v", test.value, test.name, in.Answer[0])
+		}
+	}
+
+	// Other classes have no records
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeA)
+	m.Question[0].Qclass = dns.ClassHESIOD
+	in, err := dns.Exchange(m, "127.0.0.1:15353")
+	if err != nil || in.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED for class HS, but got %v [%v]", in, err)
+	}
+}
+
+func TestChaosHideVersion(t *testing.T) {
+	config := setupConfig()
+	config.Identity.HideVersion = true
+	logger := zaptest.NewLogger(t)
+	dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	dnsServer.ConfigureIdentity(&config)
+	defer startDNSServer(dnsServer)()
+
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	in, err := dns.Exchange(m, "127.0.0.1:15353")
+	if err != nil || in.Rcode != dns.RcodeRefused || len(in.Answer) != 0 {
+		t.Errorf("Expected version query to be refused, but got %v [%v]", in, err)
+	}
+	// The server id defaults to the hostname
+	if dnsServer.identity.id == "" {
+		t.Errorf("Expected hostname as server id")
+	}
+}
+
+func TestNSID(t *testing.T) {
+	config := setupConfig()
+	config.Identity.ServerID = "node1"
+	logger := zaptest.NewLogger(t)
+	dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	dnsServer.ConfigureIdentity(&config)
+	defer startDNSServer(dnsServer)()
+
+	for _, ask := range []bool{true, false} {
+		m := new(dns.Msg)
+		m.SetQuestion("auth.example.org.", dns.TypeA)
+		m.SetEdns0(1232, false)
+		if ask {
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		}
+		in, err := dns.Exchange(m, "127.0.0.1:15353")
+		if err != nil {
+			t.Fatalf("Unexpected error [%v]", err)
+		}
+		var nsid *dns.EDNS0_NSID
+		if opt := in.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if n, ok := o.(*dns.EDNS0_NSID); ok {
+					nsid = n
+				}
+			}
+		}
+		switch {
+		case ask && (nsid == nil || nsid.Nsid != hex.EncodeToString([]byte("node1"))):
+			t.Errorf("Expected NSID node1, but got %v", nsid)
+		case !ask && nsid != nil:
+			t.Errorf("Expected no NSID without asking, but got %v", nsid)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryTXT asks the DNS server at addr for the TXT values at a name, over "udp" or
+// "tcp". Truncated UDP answers are retried over TCP. A name without TXT records
+// has no values. The query is marked as a propagation check, which dnsacmed servers
+// leave out of their query log.
+func QueryTXT(ctx context.Context, network string, addr string, name string) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	m.SetEdns0(DefaultMaxUDPSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: propagationCheckOption})
+	c := &dns.Client{Net: network}
+	in, _, err := c.ExchangeContext(ctx, m, addr)
+	if err == nil && in.Truncated && network == "udp" {
+		c.Net = "tcp"
+		in, _, err = c.ExchangeContext(ctx, m, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("Received %s from %s", dns.RcodeToString[in.Rcode], addr)
+	}
+	values := []string{}
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, m.Question[0].Name) {
+			values = append(values, txt.Txt...)
+		}
+	}
+	return values, nil
+}
+
+// TXTValues returns the TXT values the server answers with for a name, without
+// sending it a query. Unlike with QueryTXT, the query ACL and rate limiting don't
+// apply.
+func (d *DNSServer) TXTValues(name string) ([]string, error) {
+	q := dns.Question{Name: dns.Fqdn(name), Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+	rr, rcode, _, err := d.answer(q)
+	if err != nil {
+		return nil, err
+	}
+	if rcode != dns.RcodeSuccess && rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("Answered with %s", dns.RcodeToString[rcode])
+	}
+	values := []string{}
+	for _, r := range rr {
+		if txt, ok := r.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, q.Name) {
+			values = append(values, txt.Txt...)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Retry policy for NOTIFY messages that are not acknowledged
+const (
+	notifyAttempts = 3
+	notifyTimeout  = 2 * time.Second
+)
+
+// Notifier sends NOTIFY messages (RFC 1996) to the secondary name servers when the
+// zones change. Notifications requested while a round is in progress are coalesced
+// into a single following round.
+type Notifier struct {
+	logger      *zap.Logger
+	zones       []string
+	secondaries []string
+	client      *dns.Client
+	pending     chan struct{}
+	done        chan struct{}
+}
+
+// NewNotifier creates a notifier for all zones in the config and starts sending
+// notifications in the background until Close is called
+func NewNotifier(logger *zap.Logger, config *Config) *Notifier {
+	n := &Notifier{
+		logger:      logger,
+		secondaries: config.Transfer.Notify,
+		client:      &dns.Client{Net: "udp", Timeout: notifyTimeout},
+		pending:     make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	for _, zone := range config.AllZones() {
+		n.zones = append(n.zones, dns.Fqdn(NormalizeZone(zone.Domain)))
+	}
+	go n.run()
+	return n
+}
+
+// Notify schedules a round of notifications. All zones are notified, as they share
+// a single serial.
+func (n *Notifier) Notify() {
+	select {
+	case n.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the notifier
+func (n *Notifier) Close() {
+	close(n.done)
+}
+
+func (n *Notifier) run() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.pending:
+			for _, zone := range n.zones {
+				for _, addr := range n.secondaries {
+					if err := n.notify(zone, addr); err != nil {
+						n.logger.Warn("Could not notify secondary", zap.Error(err), zap.String("zone", zone), zap.String("secondary", addr))
+					}
+				}
+			}
+		}
+	}
+}
+
+func (n *Notifier) notify(zone string, addr string) error {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	var err error
+	for i := 0; i < notifyAttempts; i++ {
+		var in *dns.Msg
+		in, _, err = n.client.Exchange(m, addr)
+		if err == nil {
+			if in.Rcode != dns.RcodeSuccess {
+				n.logger.Warn("Secondary rejected NOTIFY", zap.String("zone", zone), zap.String("secondary", addr), zap.String("rcode", dns.RcodeToString[in.Rcode]))
+			}
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultQueryLogAccounts is the number of accounts queries are kept for unless
+// configured otherwise
+const DefaultQueryLogAccounts = 10000
+
+// propagationCheckOption is the EDNS0 option, from the range for local use, that
+// marks the queries of propagation checks. They aren't kept in the query log, so
+// that they don't push out the queries of the CA.
+const propagationCheckOption = 65001
+
+// QueryLogEntry is a query for the name of an account and how it was answered. The
+// rcode is empty if the query was dropped by rate limiting.
+type QueryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Resolver  string    `json:"resolver"`
+	Qtype     string    `json:"qtype"`
+	Rcode     string    `json:"rcode"`
+	Truncated bool      `json:"truncated"`
+	Dropped   bool      `json:"dropped"`
+	Values    []string  `json:"values"`
+}
+
+// QueryLog keeps the recent queries for the name of each account in memory, so that
+// account owners can check whether their CA queried the server and what it got. It is
+// shared by all servers.
+type QueryLog struct {
+	sync.Mutex
+	size     int
+	accounts int
+	entries  map[string]*list.Element
+	// lru holds the query rings of the accounts, most recently queried first
+	lru *list.List
+	now func() time.Time
+}
+
+// queryRing holds the last queries of an account, overwriting the oldest
+type queryRing struct {
+	subdomain string
+	queries   []QueryLogEntry
+	next      int
+}
+
+// NewQueryLog returns a query log as configured, or nil if it is disabled
+func NewQueryLog(config *Config) *QueryLog {
+	if config.QueryLog.Size <= 0 {
+		return nil
+	}
+	accounts := config.QueryLog.Accounts
+	if accounts <= 0 {
+		accounts = DefaultQueryLogAccounts
+	}
+	return &QueryLog{
+		size:     config.QueryLog.Size,
+		accounts: accounts,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// add records a query for an account. The least recently queried account is
+// forgotten once there are too many.
+func (l *QueryLog) add(subdomain string, entry QueryLogEntry) {
+	l.Lock()
+	defer l.Unlock()
+	entry.Time = l.now()
+	var ring *queryRing
+	if e, ok := l.entries[subdomain]; ok {
+		l.lru.MoveToFront(e)
+		ring = e.Value.(*queryRing)
+	} else {
+		ring = &queryRing{subdomain: subdomain}
+		l.entries[subdomain] = l.lru.PushFront(ring)
+		for l.lru.Len() > l.accounts {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.entries, oldest.Value.(*queryRing).subdomain)
+		}
+	}
+	if len(ring.queries) < l.size {
+		ring.queries = append(ring.queries, entry)
+		return
+	}
+	ring.queries[ring.next] = entry
+	ring.next = (ring.next + 1) % l.size
+}
+
+// Queries returns the recent queries for an account, newest first
+func (l *QueryLog) Queries(subdomain string) []QueryLogEntry {
+	l.Lock()
+	defer l.Unlock()
+	queries := []QueryLogEntry{}
+	e, ok := l.entries[strings.ToLower(subdomain)]
+	if !ok {
+		return queries
+	}
+	ring := e.Value.(*queryRing)
+	for i := len(ring.queries) - 1; i >= 0; i-- {
+		queries = append(queries, ring.queries[(ring.next+i)%len(ring.queries)])
+	}
+	return queries
+}
+
+// logQuery records the reply sent to a query for the name of an account, or nil if
+// none was sent
+func (d *DNSServer) logQuery(ip net.IP, r *dns.Msg, m *dns.Msg) {
+	if d.QueryLog == nil || isPropagationCheck(r) {
+		return
+	}
+	for _, q := range r.Question {
+		if q.Qclass == dns.ClassCHAOS {
+			continue
+		}
+		subdomain, _, ok := d.accountName(q.Name)
+		if !ok || !d.isAccount(q.Name) {
+			continue
+		}
+		entry := QueryLogEntry{
+			Resolver: ip.String(),
+			Qtype:    dns.TypeToString[q.Qtype],
+			Dropped:  m == nil,
+			Values:   []string{},
+		}
+		if m != nil {
+			entry.Rcode = dns.RcodeToString[m.Rcode]
+			entry.Truncated = m.Truncated
+			for _, rr := range m.Answer {
+				if txt, ok := rr.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, q.Name) {
+					entry.Values = append(entry.Values, txt.Txt...)
+				}
+			}
+		}
+		d.QueryLog.add(subdomain, entry)
+	}
+}
+
+// isPropagationCheck checks if a query was sent by QueryTXT
+func isPropagationCheck(r *dns.Msg) bool {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == propagationCheckOption {
+				return true
+			}
+		}
+	}
+	return false
+}
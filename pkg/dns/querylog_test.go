@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestQueryLogRing(t *testing.T) {
+	config := setupConfig()
+	config.QueryLog = QueryLogConfig{Size: 3, Accounts: 2}
+	l := NewQueryLog(&config)
+	for _, qtype := range []string{"A", "AAAA", "TXT", "MX"} {
+		l.add("a", QueryLogEntry{Qtype: qtype})
+	}
+	queries := l.Queries("a")
+	if len(queries) != 3 || queries[0].Qtype != "MX" || queries[1].Qtype != "TXT" || queries[2].Qtype != "AAAA" {
+		t.Errorf("Expected the last 3 queries newest first, but got %v", queries)
+	}
+
+	// Querying b and c forgets a, which was queried least recently
+	l.add("b", QueryLogEntry{Qtype: "TXT"})
+	l.add("c", QueryLogEntry{Qtype: "TXT"})
+	if queries := l.Queries("a"); len(queries) != 0 {
+		t.Errorf("Expected queries of the least recently queried account to be forgotten, but got %v", queries)
+	}
+	if queries := l.Queries("B"); len(queries) != 1 {
+		t.Errorf("Expected one query for b, but got %v", queries)
+	}
+
+	config.QueryLog.Size = 0
+	if NewQueryLog(&config) != nil {
+		t.Errorf("Expected query log to be disabled")
+	}
+}
+
+func TestQueryLogServer(t *testing.T) {
+	config := setupConfig()
+	config.QueryLog = QueryLogConfig{Size: 10}
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	dnsServer := NewDNSServer(logger, db, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	dnsServer.QueryLog = NewQueryLog(&config)
+	defer startDNSServer(dnsServer)()
+
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________valid_response_______________"
+	if err = db.Update(&atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{atxt.Subdomain + ".auth.example.org", dns.TypeTXT},
+		{atxt.Subdomain + ".auth.example.org", dns.TypeA},
+		// Only queries for the name of the account are kept
+		{"_acme-challenge." + atxt.Subdomain + ".auth.example.org", dns.TypeTXT},
+		{"nonexistent.auth.example.org", dns.TypeTXT},
+		{"ns1.auth.example.org", dns.TypeA},
+	} {
+		if answer, _ := resolv.lookup(q.name, q.qtype); answer == nil {
+			t.Fatalf("No answer for %s", q.name)
+		}
+	}
+
+	// Propagation checks are left out
+	if _, err = QueryTXT(context.Background(), "udp", "127.0.0.1:15353", atxt.Subdomain+".auth.example.org"); err != nil {
+		t.Fatalf("Propagation check failed: [%v]", err)
+	}
+
+	queries := dnsServer.QueryLog.Queries(atxt.Subdomain)
+	if len(queries) != 2 {
+		t.Fatalf("Expected 2 queries, but got %v", queries)
+	}
+	if q := queries[0]; q.Qtype != "A" || q.Rcode != "NOERROR" || len(q.Values) != 0 {
+		t.Errorf("Unexpected A query %+v", q)
+	}
+	if q := queries[1]; q.Qtype != "TXT" || q.Rcode != "NOERROR" || q.Resolver != "127.0.0.1" || len(q.Values) != 1 || q.Values[0] != atxt.Value || q.Time.IsZero() {
+		t.Errorf("Unexpected TXT query %+v", q)
+	}
+}
+
+func TestQueryLogRateLimited(t *testing.T) {
+	config := setupConfig()
+	config.QueryLog = QueryLogConfig{Size: 10}
+	config.RateLimit = RateLimitConfig{ResponsesPerSecond: 1, Slip: 2}
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	dnsServer := NewDNSServer(logger, db, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	dnsServer.QueryLog = NewQueryLog(&config)
+	if err := dnsServer.ConfigureRateLimit(&config); err != nil {
+		t.Fatalf("Could not configure rate limiting: [%v]", err)
+	}
+	defer startDNSServer(dnsServer)()
+
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________valid_response_______________"
+	if err = db.Update(&atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(atxt.Subdomain+".auth.example.org.", dns.TypeTXT)
+	c := &dns.Client{Timeout: 200 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		// The dropped query times out
+		_, _, _ = c.Exchange(m, "127.0.0.1:15353")
+	}
+
+	// The log tells what was sent, not what would have been answered
+	queries := dnsServer.QueryLog.Queries(atxt.Subdomain)
+	if len(queries) != 3 {
+		t.Fatalf("Expected 3 queries, but got %v", queries)
+	}
+	if q := queries[2]; q.Rcode != "NOERROR" || q.Truncated || q.Dropped || len(q.Values) != 1 {
+		t.Errorf("Unexpected answered query %+v", q)
+	}
+	// With slip 2, the first limited response is dropped and the second truncated
+	if q := queries[1]; q.Rcode != "" || !q.Dropped || len(q.Values) != 0 {
+		t.Errorf("Unexpected dropped query %+v", q)
+	}
+	if q := queries[0]; q.Rcode != "NOERROR" || !q.Truncated || q.Dropped || len(q.Values) != 0 {
+		t.Errorf("Unexpected truncated query %+v", q)
+	}
+}
@@ -0,0 +1,204 @@
+package dns
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Defaults for the client network prefix lengths used by response rate limiting
+const (
+	DefaultRateLimitIPv4PrefixLength = 24
+	DefaultRateLimitIPv6PrefixLength = 56
+)
+
+// Counters of responses affected by rate limiting, published with expvar
+var (
+	rateLimitDropped   = expvar.NewInt("dns_rate_limit_dropped")
+	rateLimitSlipped   = expvar.NewInt("dns_rate_limit_slipped")
+	rateLimitBadCookie = expvar.NewInt("dns_rate_limit_badcookie")
+)
+
+// rateLimitAction is what to do with a response
+type rateLimitAction int
+
+const (
+	rateLimitSend rateLimitAction = iota
+	rateLimitSlip
+	rateLimitDrop
+)
+
+// rateLimitKey identifies a stream of identical responses to a client network.
+// Negative answers are keyed by zone, so that random names don't escape the limit.
+type rateLimitKey struct {
+	network string
+	name    string
+	qtype   uint16
+	rcode   int
+}
+
+type rateLimitBucket struct {
+	tokens float64
+	last   time.Time
+	// limited counts the responses limited since the bucket last ran empty
+	limited int
+}
+
+// rateLimiter implements response rate limiting (RRL) with a token bucket per key
+type rateLimiter struct {
+	sync.Mutex
+	logger    *zap.Logger
+	rate      float64
+	slip      int
+	v4mask    net.IPMask
+	v6mask    net.IPMask
+	exempt    model.CIDRSlice
+	buckets   map[rateLimitKey]*rateLimitBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// ConfigureRateLimit sets up response rate limiting of UDP answers
+func (d *DNSServer) ConfigureRateLimit(config *Config) error {
+	c := config.RateLimit
+	if c.ResponsesPerSecond < 0 {
+		return fmt.Errorf("Option dns.rate_limit.responses_per_second must not be negative")
+	}
+	if c.Slip < 0 {
+		return fmt.Errorf("Option dns.rate_limit.slip must not be negative")
+	}
+	if c.ResponsesPerSecond == 0 {
+		d.rateLimiter = nil
+		return nil
+	}
+	if c.IPv4PrefixLength == 0 {
+		c.IPv4PrefixLength = DefaultRateLimitIPv4PrefixLength
+	}
+	if c.IPv6PrefixLength == 0 {
+		c.IPv6PrefixLength = DefaultRateLimitIPv6PrefixLength
+	}
+	if c.IPv4PrefixLength < 0 || c.IPv4PrefixLength > 32 {
+		return fmt.Errorf("Option dns.rate_limit.ipv4_prefix_length must be between 1 and 32")
+	}
+	if c.IPv6PrefixLength < 0 || c.IPv6PrefixLength > 128 {
+		return fmt.Errorf("Option dns.rate_limit.ipv6_prefix_length must be between 1 and 128")
+	}
+	exempt, err := model.ParseCIDRSlice(c.Exempt)
+	if err != nil {
+		return fmt.Errorf("Option dns.rate_limit.exempt: %w", err)
+	}
+	d.rateLimiter = &rateLimiter{
+		logger:  d.logger,
+		rate:    float64(c.ResponsesPerSecond),
+		slip:    c.Slip,
+		v4mask:  net.CIDRMask(c.IPv4PrefixLength, 32),
+		v6mask:  net.CIDRMask(c.IPv6PrefixLength, 128),
+		exempt:  exempt,
+		buckets: make(map[rateLimitKey]*rateLimitBucket),
+		now:     time.Now,
+	}
+	return nil
+}
+
+// check decides whether a response to a client is sent, sent truncated or dropped.
+// Only UDP responses are limited, as TCP clients can't spoof their address.
+func (l *rateLimiter) check(addr net.Addr, m *dns.Msg) rateLimitAction {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || len(l.exempt) > 0 && l.exempt.Contains(udpAddr.IP) {
+		return rateLimitSend
+	}
+	key := l.key(udpAddr.IP, m)
+
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{tokens: l.rate, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return rateLimitSend
+	}
+
+	b.limited++
+	if b.limited == 1 {
+		l.logger.Info("Rate limiting responses", zap.String("network", key.network), zap.String("name", key.name),
+			zap.String("qtype", dns.TypeToString[key.qtype]), zap.String("rcode", dns.RcodeToString[key.rcode]))
+	}
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		return rateLimitSlip
+	}
+	return rateLimitDrop
+}
+
+// key returns the rate limiting key of a response to a client
+func (l *rateLimiter) key(ip net.IP, m *dns.Msg) rateLimitKey {
+	var network net.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		network = ip4.Mask(l.v4mask)
+	} else {
+		network = ip.Mask(l.v6mask)
+	}
+	key := rateLimitKey{network: network.String(), rcode: m.Rcode}
+	if len(m.Question) > 0 {
+		key.name = strings.ToLower(m.Question[0].Name)
+		key.qtype = m.Question[0].Qtype
+	}
+	switch {
+	case m.Rcode == dns.RcodeNameError || m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0:
+		// Negative answers carry the SOA of the zone
+		key.qtype = 0
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				key.name = strings.ToLower(rr.Header().Name)
+			}
+		}
+	case m.Rcode != dns.RcodeSuccess:
+		// All errors to a network share a bucket
+		key.name = ""
+		key.qtype = 0
+	}
+	return key
+}
+
+// sweep forgets buckets that have been refilled completely, which behave like new
+// ones. It runs at most once a second to keep the cost of a check low.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Second {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= time.Second {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// truncated returns an empty truncated reply, prompting the client to retry over TCP
+func truncated(m *dns.Msg) *dns.Msg {
+	t := new(dns.Msg)
+	t.MsgHdr = m.MsgHdr
+	t.Truncated = true
+	t.Question = m.Question
+	if opt := m.IsEdns0(); opt != nil {
+		t.Extra = []dns.RR{opt}
+	}
+	return t
+}
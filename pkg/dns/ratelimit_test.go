@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupRateLimiter(t *testing.T, rl RateLimitConfig) (*rateLimiter, *time.Time) {
+	config := setupConfig()
+	config.RateLimit = rl
+	dnsServer := NewDNSServer(zaptest.NewLogger(t), nil, config.Listen, config.Proto, config.Domain)
+	if err := dnsServer.ConfigureRateLimit(&config); err != nil {
+		t.Fatalf("Could not configure rate limiting: [%v]", err)
+	}
+	now := time.Unix(1600000000, 0)
+	dnsServer.rateLimiter.now = func() time.Time { return now }
+	return dnsServer.rateLimiter, &now
+}
+
+func answerMsg(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	rr, _ := dns.NewRR(name + " 1 TXT answer")
+	m.Answer = []dns.RR{rr}
+	return m
+}
+
+func nxdomainMsg(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	soa, _ := dns.NewRR("auth.example.org. 3600 SOA ns1.auth.example.org. admin.example.org. 1 2 3 4 5")
+	m.Ns = []dns.RR{soa}
+	return m
+}
+
+func TestRateLimit(t *testing.T) {
+	l, now := setupRateLimiter(t, RateLimitConfig{ResponsesPerSecond: 2, Slip: 2, Exempt: []string{"192.0.2.128/25"}})
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	neighbour := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+	m := answerMsg("auth.example.org.")
+
+	var actions []rateLimitAction
+	for i := 0; i < 5; i++ {
+		actions = append(actions, l.check(client, m))
+	}
+	expected := []rateLimitAction{rateLimitSend, rateLimitSend, rateLimitDrop, rateLimitSlip, rateLimitDrop}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Fatalf("Expected actions %v, but got %v", expected, actions)
+		}
+	}
+	if l.check(neighbour, m) == rateLimitSend {
+		t.Errorf("Expected clients in the same network to share the limit")
+	}
+	if l.check(client, answerMsg("other.auth.example.org.")) != rateLimitSend {
+		t.Errorf("Expected different responses to be limited separately")
+	}
+	if l.check(&net.UDPAddr{IP: net.ParseIP("192.0.2.200")}, m) != rateLimitSend {
+		t.Errorf("Expected exempt network not to be limited")
+	}
+	if l.check(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, m) != rateLimitSend {
+		t.Errorf("Expected TCP responses not to be limited")
+	}
+
+	*now = now.Add(time.Second)
+	if l.check(client, m) != rateLimitSend {
+		t.Errorf("Expected limit to be lifted after a second")
+	}
+}
+
+func TestRateLimitNXDOMAIN(t *testing.T) {
+	l, _ := setupRateLimiter(t, RateLimitConfig{ResponsesPerSecond: 1})
+	client := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	if l.check(client, nxdomainMsg("random1.auth.example.org.")) != rateLimitSend {
+		t.Errorf("Expected first response to be sent")
+	}
+	if l.check(&net.UDPAddr{IP: net.ParseIP("2001:db8::2")}, nxdomainMsg("random2.auth.example.org.")) != rateLimitDrop {
+		t.Errorf("Expected NXDOMAIN responses for random names in a zone to share the limit")
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	l, now := setupRateLimiter(t, RateLimitConfig{ResponsesPerSecond: 1})
+	_ = l.check(&net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, answerMsg("auth.example.org."))
+	*now = now.Add(2 * time.Second)
+	_ = l.check(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}, answerMsg("auth.example.org."))
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected idle buckets to be forgotten, but have %d", len(l.buckets))
+	}
+}
+
+func TestRateLimitServer(t *testing.T) {
+	config := setupConfig()
+	config.RateLimit = RateLimitConfig{ResponsesPerSecond: 1, Slip: 1}
+	logger := zaptest.NewLogger(t)
+	_, stop := setupConfiguredDNSServer(t, config, logger, nil)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeA)
+	c := new(dns.Client)
+	if in, _, err := c.Exchange(m, "127.0.0.1:15353"); err != nil || in.Truncated || len(in.Answer) == 0 {
+		t.Fatalf("Expected full answer to first query, but got %v with error [%v]", in, err)
+	}
+	in, _, err := c.Exchange(m, "127.0.0.1:15353")
+	if err != nil {
+		t.Fatalf("Error querying the server [%v]", err)
+	}
+	if !in.Truncated || len(in.Answer) != 0 {
+		t.Errorf("Expected truncated empty answer to limited query, but got %v", in)
+	}
+}
+
+func TestConfigureRateLimitErrors(t *testing.T) {
+	for _, rl := range []RateLimitConfig{
+		{ResponsesPerSecond: -1},
+		{ResponsesPerSecond: 1, Slip: -1},
+		{ResponsesPerSecond: 1, IPv4PrefixLength: 33},
+		{ResponsesPerSecond: 1, IPv6PrefixLength: 129},
+		{ResponsesPerSecond: 1, Exempt: []string{"not a network"}},
+	} {
+		config := setupConfig()
+		config.RateLimit = rl
+		dnsServer := NewDNSServer(zaptest.NewLogger(t), nil, config.Listen, config.Proto, config.Domain)
+		if err := dnsServer.ConfigureRateLimit(&config); err == nil {
+			t.Errorf("Expected error for rate limit config %+v", rl)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// transferChunkSize is the number of records sent per message in a zone transfer
+const transferChunkSize = 100
+
+// ConfigureTransfers sets up access control for zone transfers and the TSIG keys
+// the server accepts
+func (d *DNSServer) ConfigureTransfers(config *Config) error {
+	acl, err := model.ParseCIDRSlice(config.Transfer.AllowFrom)
+	if err != nil {
+		return fmt.Errorf("Option dns.transfer.allow_from: %w", err)
+	}
+	d.transferACL = acl
+	deny, err := model.ParseCIDRSlice(config.Transfer.DenyFrom)
+	if err != nil {
+		return fmt.Errorf("Option dns.transfer.deny_from: %w", err)
+	}
+	d.transferDeny = deny
+	secrets := make(map[string]string)
+	for name, secret := range config.TSIGKeys {
+		secrets[dns.Fqdn(strings.ToLower(name))] = secret
+	}
+	d.transferTSIGKey = ""
+	if config.Transfer.TSIGKey != "" {
+		d.transferTSIGKey = dns.Fqdn(strings.ToLower(config.Transfer.TSIGKey))
+		if _, ok := secrets[d.transferTSIGKey]; !ok {
+			return fmt.Errorf("Option dns.transfer.tsig_key: unknown key %s", config.Transfer.TSIGKey)
+		}
+	}
+	d.Server.TsigProvider = tsigKeyring{db: d.DB, secrets: secrets}
+	return nil
+}
+
+// transferAllowed checks the transport, source address and TSIG signature of a
+// transfer request
+func (d *DNSServer) transferAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	addr, ok := w.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		// Transfers are only done over TCP (RFC 5936)
+		return false
+	}
+	// Unlike for accounts, an empty list allows nobody
+	if len(d.transferACL) == 0 || !d.transferACL.Contains(addr.IP) {
+		return false
+	}
+	if len(d.transferDeny) > 0 && d.transferDeny.Contains(addr.IP) {
+		return false
+	}
+	if d.transferTSIGKey != "" {
+		tsig := r.IsTsig()
+		if tsig == nil || w.TsigStatus() != nil || strings.ToLower(tsig.Hdr.Name) != d.transferTSIGKey {
+			return false
+		}
+	}
+	return true
+}
+
+// handleTransfer answers AXFR and IXFR requests. IXFR is answered with the full
+// zone unless the client is already up to date, as we keep no history (RFC 1995).
+func (d *DNSServer) handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	zone := strings.ToLower(q.Name)
+	m := new(dns.Msg)
+	if !d.transferAllowed(w, r) {
+		d.logger.Info("Refusing zone transfer", zap.String("zone", zone), zap.String("client", w.RemoteAddr().String()))
+		m.SetRcode(r, dns.RcodeRefused)
+		_ = w.WriteMsg(m)
+		return
+	}
+	soa, ok := d.zone().zones[zone]
+	if !ok {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		_ = w.WriteMsg(m)
+		return
+	}
+	if d.zone().signers[zone] != nil {
+		// Signed zones are signed while answering, so the transfer would carry no
+		// signatures or NSEC records, and validators would reject the secondaries
+		d.logger.Warn("Refusing transfer of a signed zone", zap.String("zone", zone), zap.String("client", w.RemoteAddr().String()))
+		m.SetRcode(r, dns.RcodeRefused)
+		_ = w.WriteMsg(m)
+		return
+	}
+	soa = d.withSerial(soa)
+
+	var records []dns.RR
+	if q.Qtype == dns.TypeIXFR && len(r.Ns) == 1 {
+		if client, ok := r.Ns[0].(*dns.SOA); ok && !serialLess(client.Serial, soa.(*dns.SOA).Serial) {
+			records = []dns.RR{soa}
+		}
+	}
+	if records == nil {
+		var err error
+		records, err = d.zoneRecords(zone, soa)
+		if err != nil {
+			d.logger.Error("While collecting zone for transfer", zap.Error(err), zap.String("zone", zone))
+			m.SetRcode(r, dns.RcodeServerFailure)
+			_ = w.WriteMsg(m)
+			return
+		}
+	}
+
+	d.logger.Info("Transferring zone", zap.String("zone", zone), zap.String("qtype", dns.TypeToString[q.Qtype]),
+		zap.String("client", w.RemoteAddr().String()), zap.Int("records", len(records)))
+	ch := make(chan *dns.Envelope, len(records)/transferChunkSize+1)
+	for len(records) > 0 {
+		n := transferChunkSize
+		if n > len(records) {
+			n = len(records)
+		}
+		ch <- &dns.Envelope{RR: records[:n]}
+		records = records[n:]
+	}
+	close(ch)
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, r, ch); err != nil {
+		d.logger.Error("While transferring zone", zap.Error(err), zap.String("zone", zone))
+	}
+}
+
+// zoneRecords returns all records of a zone in AXFR order, starting and ending
+// with the SOA record
+func (d *DNSServer) zoneRecords(zone string, soa dns.RR) ([]dns.RR, error) {
+	z := d.zone()
+	records := []dns.RR{soa}
+	var names []string
+	for name := range z.domains {
+		if found, ok := d.findZone(name); ok && found == zone {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, rr := range z.domains[name].Records {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				records = append(records, rr)
+			}
+		}
+	}
+	if zone == d.Domain && d.PersonalKeyAuth != "" {
+		own, _ := d.answerOwnChallenge(dns.Question{Name: "_acme-challenge." + zone, Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+		records = append(records, own...)
+	}
+	if d.DB != nil {
+		txts, err := d.DB.ListTXT()
+		if err != nil {
+			return nil, err
+		}
+		for i := range txts {
+			txt := &txts[i]
+			if d.accountZone(txt) != zone {
+				continue
+			}
+			r := new(dns.TXT)
+			r.Hdr = dns.RR_Header{Name: txt.Subdomain + "." + zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: z.txtTTL}
+			r.Txt = append(r.Txt, txt.Value)
+			records = append(records, r)
+		}
+	}
+	return append(records, soa), nil
+}
+
+// serialLess compares two SOA serials using serial number arithmetic (RFC 1982)
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
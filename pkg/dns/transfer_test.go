@@ -0,0 +1,244 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+const testTSIGSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA=="
+
+func setupTransferServer(t *testing.T, transfer TransferConfig) (*DNSServer, func() error) {
+	config := setupConfig()
+	config.Proto = "tcp"
+	config.Transfer = transfer
+	config.TSIGKeys = map[string]string{"transfer-key": testTSIGSecret}
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	dnsServer := NewDNSServer(logger, db, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	if err := dnsServer.ConfigureTransfers(&config); err != nil {
+		t.Fatalf("Could not configure transfers: [%v]", err)
+	}
+	return dnsServer, startDNSServer(dnsServer)
+}
+
+func transferIn(t *testing.T, m *dns.Msg, tsig bool) ([]dns.RR, error) {
+	tr := new(dns.Transfer)
+	if tsig {
+		tr.TsigSecret = map[string]string{"transfer-key.": testTSIGSecret}
+		m.SetTsig("transfer-key.", dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	env, err := tr.In(m, "127.0.0.1:15353")
+	if err != nil {
+		return nil, err
+	}
+	var records []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return records, e.Error
+		}
+		records = append(records, e.RR...)
+	}
+	return records, nil
+}
+
+func TestAXFR(t *testing.T) {
+	dnsServer, stop := setupTransferServer(t, TransferConfig{AllowFrom: []string{"127.0.0.0/8"}})
+	defer stop()
+
+	atxt, err := dnsServer.DB.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________valid_response_______________"
+	if err = dnsServer.DB.Update(&atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr("auth.example.org.")
+	records, err := transferIn(t, m, false)
+	if err != nil {
+		t.Fatalf("Zone transfer failed: [%v]", err)
+	}
+	if len(records) < 2 || records[0].Header().Rrtype != dns.TypeSOA || records[len(records)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("Expected transfer to start and end with SOA, but got %v", records)
+	}
+	found := map[string]bool{}
+	for _, rr := range records {
+		found[rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype]] = true
+		if rr.Header().Name == "cn.example.org." {
+			t.Errorf("Did not expect record outside the zone in transfer: [%s]", rr)
+		}
+	}
+	for _, expected := range []string{
+		"auth.example.org. A",
+		"ns1.auth.example.org. A",
+		atxt.Subdomain + ".auth.example.org. TXT",
+	} {
+		if !found[expected] {
+			t.Errorf("Expected %s in transfer, but got %v", expected, records)
+		}
+	}
+
+	// A client with the current serial gets just the SOA
+	serial := records[0].(*dns.SOA).Serial
+	m = new(dns.Msg)
+	m.SetIxfr("auth.example.org.", serial, "ns1.auth.example.org.", "admin.example.org.")
+	records, err = transferIn(t, m, false)
+	if err != nil {
+		t.Fatalf("Zone transfer failed: [%v]", err)
+	}
+	if len(records) != 1 {
+		t.Errorf("Expected a single SOA for an up to date IXFR client, but got %v", records)
+	}
+
+	// An outdated client gets the full zone
+	m = new(dns.Msg)
+	m.SetIxfr("auth.example.org.", serial-1, "ns1.auth.example.org.", "admin.example.org.")
+	records, err = transferIn(t, m, false)
+	if err != nil {
+		t.Fatalf("Zone transfer failed: [%v]", err)
+	}
+	if len(records) < 3 {
+		t.Errorf("Expected the full zone for an outdated IXFR client, but got %v", records)
+	}
+
+	m = new(dns.Msg)
+	m.SetAxfr("example.org.")
+	if _, err = transferIn(t, m, false); err == nil {
+		t.Errorf("Expected transfer of a zone we don't serve to fail")
+	}
+}
+
+func TestAXFRRefused(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		transfer TransferConfig
+		tsig     bool
+		allowed  bool
+	}{
+		{"no acl", TransferConfig{}, false, false},
+		{"outside acl", TransferConfig{AllowFrom: []string{"10.0.0.0/8"}}, false, false},
+		{"denied", TransferConfig{AllowFrom: []string{"127.0.0.0/8"}, DenyFrom: []string{"127.0.0.1/32"}}, false, false},
+		{"tsig missing", TransferConfig{AllowFrom: []string{"127.0.0.1/32"}, TSIGKey: "transfer-key"}, false, false},
+		{"tsig", TransferConfig{AllowFrom: []string{"127.0.0.1/32"}, TSIGKey: "transfer-key"}, true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, stop := setupTransferServer(t, test.transfer)
+			defer stop()
+			m := new(dns.Msg)
+			m.SetAxfr("auth.example.org.")
+			_, err := transferIn(t, m, test.tsig)
+			if test.allowed && err != nil {
+				t.Errorf("Expected transfer to succeed, but got error [%v]", err)
+			}
+			if !test.allowed && err == nil {
+				t.Errorf("Expected transfer to be refused")
+			}
+		})
+	}
+}
+
+func TestAXFRSignedZoneRefused(t *testing.T) {
+	dir := t.TempDir()
+	kskPath, _ := writeKeyPair(t, dir, "auth.example.org", 257)
+	zskPath, _ := writeKeyPair(t, dir, "auth.example.org", 256)
+	config := setupConfig()
+	config.Proto = "tcp"
+	config.Transfer = TransferConfig{AllowFrom: []string{"127.0.0.0/8"}}
+	config.DNSSECKeys = []string{kskPath + ".key", zskPath}
+	logger := zaptest.NewLogger(t)
+	dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	dnsServer.ParseRecords(&config)
+	if err := dnsServer.LoadDNSSECKeys(&config); err != nil {
+		t.Fatalf("Could not load DNSSEC keys: [%v]", err)
+	}
+	if err := dnsServer.ConfigureTransfers(&config); err != nil {
+		t.Fatalf("Could not configure transfers: [%v]", err)
+	}
+	defer startDNSServer(dnsServer)()
+
+	m := new(dns.Msg)
+	m.SetAxfr("auth.example.org.")
+	if records, err := transferIn(t, m, false); err == nil {
+		t.Errorf("Expected transfer of a signed zone to be refused, but got %v", records)
+	}
+}
+
+func TestAXFROverUDPRefused(t *testing.T) {
+	config := setupConfig()
+	config.Transfer = TransferConfig{AllowFrom: []string{"127.0.0.0/8"}}
+	logger := zaptest.NewLogger(t)
+	_, stop := setupConfiguredDNSServer(t, config, logger, nil)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetAxfr("auth.example.org.")
+	in, err := dns.Exchange(m, "127.0.0.1:15353")
+	if err != nil {
+		t.Fatalf("Error querying the server [%v]", err)
+	}
+	if in.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED for AXFR over UDP, but got [%s]", dns.RcodeToString[in.Rcode])
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	received := make(chan string, 4)
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Opcode == dns.OpcodeNotify {
+			received <- r.Question[0].Name
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	secondary := &dns.Server{Addr: "127.0.0.1:15354", Net: "udp", Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go func() { _ = secondary.ListenAndServe() }()
+	<-started
+	defer func() { _ = secondary.Shutdown() }()
+
+	config := setupConfig()
+	config.Zones = []ZoneConfig{{Domain: "acme.eu.example.com"}}
+	config.Transfer.Notify = []string{"127.0.0.1:15354"}
+	notifier := NewNotifier(zaptest.NewLogger(t), &config)
+	defer notifier.Close()
+	notifier.Notify()
+
+	zones := map[string]bool{}
+	for len(zones) < 2 {
+		select {
+		case zone := <-received:
+			zones[zone] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for NOTIFY, got %v", zones)
+		}
+	}
+	if !zones["auth.example.org."] || !zones["acme.eu.example.com."] {
+		t.Errorf("Expected NOTIFY for all zones, but got %v", zones)
+	}
+}
+
+func TestSerialLess(t *testing.T) {
+	for _, test := range []struct {
+		a, b   uint32
+		output bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{2, 2, false},
+		{4294967295, 0, true},
+		{0, 4294967295, false},
+	} {
+		if ret := serialLess(test.a, test.b); ret != test.output {
+			t.Errorf("Expected serialLess(%d, %d) to return %t, but got %t", test.a, test.b, test.output, ret)
+		}
+	}
+}
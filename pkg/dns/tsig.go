@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jdpage/dnsacmed/pkg/db"
+	"github.com/miekg/dns"
+)
+
+// tsigKeyring looks up TSIG secrets, first among the keys from the configuration
+// and then among the accounts. The key of an account is named after its username.
+type tsigKeyring struct {
+	db      db.Database
+	secrets map[string]string
+}
+
+// secret returns the base64 encoded secret of the named key
+func (k tsigKeyring) secret(name string) (string, error) {
+	name = strings.ToLower(name)
+	if secret, ok := k.secrets[name]; ok {
+		return secret, nil
+	}
+	if account, ok := k.account(name); ok && account != "" {
+		return account, nil
+	}
+	return "", dns.ErrSecret
+}
+
+// account returns the TSIG secret of the account the key is named after
+func (k tsigKeyring) account(name string) (string, bool) {
+	if k.db == nil {
+		return "", false
+	}
+	username, err := tsigKeyUsername(name)
+	if err != nil {
+		return "", false
+	}
+	a, err := k.db.GetByUsername(username)
+	if err != nil {
+		return "", false
+	}
+	return a.TSIGSecret, true
+}
+
+// Generate implements dns.TsigProvider
+func (k tsigKeyring) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	secret, err := k.secret(t.Hdr.Name)
+	if err != nil {
+		return nil, err
+	}
+	rawsecret, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch dns.CanonicalName(t.Algorithm) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, rawsecret)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, rawsecret)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, rawsecret)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, rawsecret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, rawsecret)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// Verify implements dns.TsigProvider
+func (k tsigKeyring) Verify(msg []byte, t *dns.TSIG) error {
+	b, err := k.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(b, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// tsigKeyUsername returns the username of the account a TSIG key is named after
+func tsigKeyUsername(name string) (uuid.UUID, error) {
+	return uuid.Parse(strings.TrimSuffix(name, "."))
+}
@@ -8,4 +8,149 @@ type Config struct {
 	NSName        string   `json:"nsname"`
 	NSAdmin       string   `json:"nsadmin"`
 	StaticRecords []string `json:"records"`
+	// ZoneFile is a master file (RFC 1035) with more static records of the zone
+	ZoneFile string `json:"zonefile"`
+	// TLSListen and HTTPSListen are the addresses of the DNS-over-TLS and
+	// DNS-over-HTTPS listeners started next to the "both" protocols. Disabled if empty.
+	TLSListen   string `json:"tls_listen"`
+	HTTPSListen string `json:"https_listen"`
+	TXTTTL      uint32 `json:"txt_ttl"`
+	SOATTL      uint32 `json:"soa_ttl"`
+	SOARefresh  uint32 `json:"soa_refresh"`
+	SOARetry    uint32 `json:"soa_retry"`
+	SOAExpire   uint32 `json:"soa_expire"`
+	SOAMinimum  uint32 `json:"soa_minimum"`
+	// MaxUDPSize caps the UDP answer size advertised by clients with EDNS0
+	MaxUDPSize uint16 `json:"max_udp_size"`
+	// DNSSECKeys lists BIND style key files to sign the zone with
+	DNSSECKeys []string `json:"dnssec_keys"`
+	// Zones are served in addition to the default zone described above
+	Zones    []ZoneConfig   `json:"zones"`
+	Transfer TransferConfig `json:"transfer"`
+	// TSIGKeys maps TSIG key names to their base64 encoded HMAC-SHA256 secrets
+	TSIGKeys  map[string]string `json:"tsig_keys"`
+	RateLimit RateLimitConfig   `json:"rate_limit"`
+	Cookies   CookieConfig      `json:"cookies"`
+	Dnstap    DnstapConfig      `json:"dnstap"`
+	Identity  IdentityConfig    `json:"identity"`
+	QueryACL  QueryACLConfig    `json:"query_acl"`
+	QueryLog  QueryLogConfig    `json:"query_log"`
+}
+
+// QueryLogConfig controls the recent queries kept in memory for each account
+type QueryLogConfig struct {
+	// Size is the number of queries kept per account. Disabled if zero.
+	Size int `json:"size"`
+	// Accounts is the number of accounts queries are kept for. The least recently
+	// queried accounts are forgotten first.
+	Accounts int `json:"accounts"`
+}
+
+// QueryACLConfig restricts which clients may query the server. A query has to be
+// allowed by both the lists for all queries and those of its transport.
+type QueryACLConfig struct {
+	// AllowFrom lists the networks allowed to query, everybody if empty
+	AllowFrom []string `json:"allow_from"`
+	// DenyFrom lists networks refused even if allowed above
+	DenyFrom []string `json:"deny_from"`
+	// UDP and TCP apply to queries over that transport. DNS-over-TLS and
+	// DNS-over-HTTPS count as TCP.
+	UDP ACLConfig `json:"udp"`
+	TCP ACLConfig `json:"tcp"`
+	// Drop drops queries from clients that are not allowed instead of answering
+	// them with REFUSED
+	Drop bool `json:"drop"`
+}
+
+// ACLConfig lists networks that are allowed or denied. An empty allow list allows
+// everybody not denied.
+type ACLConfig struct {
+	AllowFrom []string `json:"allow_from"`
+	DenyFrom  []string `json:"deny_from"`
+}
+
+// IdentityConfig controls how the server identifies itself to CHAOS class queries
+// (id.server, hostname.bind, version.bind) and in the EDNS NSID option
+type IdentityConfig struct {
+	// ServerID tells which of several servers answered, the hostname if unset
+	ServerID string `json:"server_id"`
+	// Version is answered to version queries, "dnsacmed" if unset
+	Version string `json:"version"`
+	// HideVersion refuses version queries
+	HideVersion bool `json:"hide_version"`
+}
+
+// DnstapConfig controls logging of queries and responses in dnstap format
+type DnstapConfig struct {
+	// Socket is the Unix socket of a dnstap collector
+	Socket string `json:"socket"`
+	// File is written instead of a socket if set
+	File string `json:"file"`
+	// Enabled writes the messages. Can be changed at runtime by reloading the config.
+	Enabled bool `json:"enabled"`
+	// Sample writes only one in this many queries and their responses. Zero or
+	// one writes all of them.
+	Sample int `json:"sample"`
+	// Identity is the server name sent with the messages, the hostname if unset
+	Identity string `json:"identity"`
+}
+
+// CookieConfig controls DNS cookies (RFC 7873)
+type CookieConfig struct {
+	// Enabled answers client cookies with server cookies
+	Enabled bool `json:"enabled"`
+	// Secret is the base64 encoded secret server cookies are derived from. Servers
+	// answering on the same address need the same secret. Random if unset, and
+	// replaced by a new random secret on every reload.
+	Secret string `json:"secret"`
+	// PreviousSecret is a secret that server cookies are no longer created with,
+	// but still accepted from clients. Defaults to the secret replaced by a reload.
+	PreviousSecret string `json:"previous_secret"`
+	// RequireWhenLimited answers rate limited queries carrying only a client cookie
+	// with BADCOOKIE, so that the client can retry with a valid server cookie
+	RequireWhenLimited bool `json:"require_when_limited"`
+}
+
+// RateLimitConfig controls response rate limiting of UDP answers
+type RateLimitConfig struct {
+	// ResponsesPerSecond is the number of identical responses a client network gets
+	// per second. Rate limiting is disabled if zero.
+	ResponsesPerSecond int `json:"responses_per_second"`
+	// Slip is how often a limited response is sent truncated instead of being
+	// dropped, so that legitimate clients retry over TCP. Zero never slips.
+	Slip int `json:"slip"`
+	// IPv4PrefixLength and IPv6PrefixLength group clients into networks
+	IPv4PrefixLength int `json:"ipv4_prefix_length"`
+	IPv6PrefixLength int `json:"ipv6_prefix_length"`
+	// Exempt lists networks that are never limited, eg. CA validation servers
+	Exempt []string `json:"exempt"`
+}
+
+// TransferConfig controls zone transfers to secondary name servers
+type TransferConfig struct {
+	// AllowFrom lists the networks allowed to transfer the zones. Transfers are
+	// disabled if empty.
+	AllowFrom []string `json:"allow_from"`
+	// DenyFrom lists networks refused even if allowed above
+	DenyFrom []string `json:"deny_from"`
+	// TSIGKey is the name of the key transfer requests must be signed with, if set
+	TSIGKey string `json:"tsig_key"`
+	// Notify lists the addresses of the secondaries to send NOTIFY messages to
+	Notify []string `json:"notify"`
+}
+
+// ZoneConfig describes an additional zone. Unset SOA timers are inherited from
+// the default zone.
+type ZoneConfig struct {
+	Domain        string   `json:"domain"`
+	NSName        string   `json:"nsname"`
+	NSAdmin       string   `json:"nsadmin"`
+	StaticRecords []string `json:"records"`
+	ZoneFile      string   `json:"zonefile"`
+	SOATTL        uint32   `json:"soa_ttl"`
+	SOARefresh    uint32   `json:"soa_refresh"`
+	SOARetry      uint32   `json:"soa_retry"`
+	SOAExpire     uint32   `json:"soa_expire"`
+	SOAMinimum    uint32   `json:"soa_minimum"`
+	DNSSECKeys    []string `json:"dnssec_keys"`
 }
@@ -0,0 +1,183 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// txtUpdate is a single change to the TXT values of an account requested in an
+// RFC 2136 update. An empty value on deletion deletes all values.
+type txtUpdate struct {
+	add   bool
+	value string
+}
+
+// handleUpdate answers RFC 2136 updates. Updates must be signed with the TSIG key of
+// an account, and may only add or delete TXT records at the name of the account.
+func (d *DNSServer) handleUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	account, rcode := d.authorizeUpdate(w, r)
+	if rcode == dns.RcodeSuccess {
+		rcode = d.applyUpdate(account, r)
+	}
+	m.Rcode = rcode
+	if account != nil {
+		// Replies to signed requests are signed with the same key
+		tsig := r.IsTsig()
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	_ = w.WriteMsg(m)
+}
+
+// authorizeUpdate checks the zone and TSIG signature of an update, and returns the
+// account it was signed by. The account is nil if the signature was not valid.
+func (d *DNSServer) authorizeUpdate(w dns.ResponseWriter, r *dns.Msg) (*model.ACMETxt, int) {
+	q := r.Question[0]
+	zone := strings.ToLower(q.Name)
+	if q.Qtype != dns.TypeSOA {
+		return nil, dns.RcodeFormatError
+	}
+	if _, ok := d.zone().zones[zone]; !ok || d.DB == nil {
+		return nil, dns.RcodeNotAuth
+	}
+	tsig := r.IsTsig()
+	if tsig == nil {
+		d.logger.Debug("Refusing unsigned update", zap.String("zone", zone))
+		return nil, dns.RcodeRefused
+	}
+	if err := w.TsigStatus(); err != nil {
+		d.logger.Info("Refusing update with bad signature", zap.Error(err), zap.String("key", tsig.Hdr.Name))
+		return nil, dns.RcodeNotAuth
+	}
+	username, err := tsigKeyUsername(tsig.Hdr.Name)
+	if err != nil {
+		// Signed with a key from the configuration, which can't update anything
+		return nil, dns.RcodeRefused
+	}
+	account, err := d.DB.GetByUsername(username)
+	if err != nil {
+		d.logger.Error("While looking up account for update", zap.Error(err))
+		return nil, dns.RcodeServerFailure
+	}
+	if d.accountZone(account) != zone {
+		return account, dns.RcodeNotAuth
+	}
+	if addr, ok := remoteIP(w.RemoteAddr()); !ok || !account.AllowFrom.Contains(addr) {
+		d.logger.Info("Refusing update from disallowed address", zap.String("client", w.RemoteAddr().String()), zap.String("subdomain", account.Subdomain))
+		return account, dns.RcodeRefused
+	}
+	return account, dns.RcodeSuccess
+}
+
+// applyUpdate checks all records of an update before applying any of them, so that
+// invalid updates don't change anything (RFC 2136 section 3.4.1)
+func (d *DNSServer) applyUpdate(account *model.ACMETxt, r *dns.Msg) int {
+	if len(r.Answer) > 0 {
+		// Prerequisites are not supported
+		return dns.RcodeNotImplemented
+	}
+	zone := strings.ToLower(r.Question[0].Name)
+	name := account.Subdomain + "." + zone
+	var updates []txtUpdate
+	for _, rr := range r.Ns {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		if !dns.IsSubDomain(zone, owner) {
+			return dns.RcodeNotZone
+		}
+		if owner != name {
+			return dns.RcodeRefused
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				return dns.RcodeRefused
+			}
+			if len(txt.Txt) != 1 || !validTXT(txt.Txt[0]) {
+				return dns.RcodeRefused
+			}
+			updates = append(updates, txtUpdate{add: true, value: txt.Txt[0]})
+		case dns.ClassANY:
+			// Deletes all records of the type, or all records at the name
+			if h.Ttl != 0 || h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype != dns.TypeTXT && h.Rrtype != dns.TypeANY {
+				return dns.RcodeRefused
+			}
+			updates = append(updates, txtUpdate{})
+		case dns.ClassNONE:
+			// Deletes a single record
+			if h.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				return dns.RcodeRefused
+			}
+			if len(txt.Txt) != 1 {
+				return dns.RcodeRefused
+			}
+			if txt.Txt[0] == "" {
+				// Blank values are never served, so there is nothing to delete
+				continue
+			}
+			updates = append(updates, txtUpdate{value: txt.Txt[0]})
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, u := range updates {
+		var err error
+		if u.add {
+			err = d.DB.Update(&model.ACMETxtPost{Subdomain: account.Subdomain, Value: u.value})
+		} else {
+			err = d.DB.ClearTXT(account.Subdomain, u.value)
+		}
+		if err != nil {
+			d.logger.Error("While applying update", zap.Error(err), zap.String("subdomain", account.Subdomain))
+			return dns.RcodeServerFailure
+		}
+	}
+	d.logger.Debug("Applied dynamic update", zap.String("subdomain", account.Subdomain), zap.Int("changes", len(updates)))
+	return dns.RcodeSuccess
+}
+
+// accountZone returns the name of the zone an account was registered in
+func (d *DNSServer) accountZone(account *model.ACMETxt) string {
+	return d.zoneName(account.Zone)
+}
+
+// zoneName returns the fully qualified name of the zone an account was registered
+// in. Accounts registered before zones were supported have an empty zone.
+func (d *DNSServer) zoneName(zone string) string {
+	if zone == "" {
+		return d.Domain
+	}
+	return dns.Fqdn(strings.ToLower(zone))
+}
+
+// validTXT checks a TXT value against the same rules as the HTTP API
+func validTXT(s string) bool {
+	// 43 chars is the current LE auth key size, but not limited / defined by ACME
+	return utf8.RuneCountInString(s) == 43 && model.SanitizeString(s) == s
+}
+
+func remoteIP(addr net.Addr) (net.IP, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, true
+	case *net.TCPAddr:
+		return a.IP, true
+	}
+	return nil, false
+}
@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdpage/dnsacmed/pkg/model"
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+func sendUpdate(t *testing.T, m *dns.Msg, key string, secret string) *dns.Msg {
+	c := new(dns.Client)
+	if key != "" {
+		c.TsigSecret = map[string]string{key: secret}
+		m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	in, _, err := c.Exchange(m, "127.0.0.1:15353")
+	if err != nil {
+		t.Fatalf("Error sending update [%v]", err)
+	}
+	return in
+}
+
+func TestUpdate(t *testing.T) {
+	config := setupConfig()
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	_, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	atxt, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	other, err := db.Register(model.CIDRSlice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	key := atxt.Username.String() + "."
+	name := atxt.Subdomain + ".auth.example.org."
+	value := "______________valid_response_______________"
+	txt := func(name string, value string) dns.RR {
+		rr, _ := dns.NewRR(name + " 60 TXT " + value)
+		return rr
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate("auth.example.org.")
+	m.Insert([]dns.RR{txt(name, value)})
+	in := sendUpdate(t, m, key, atxt.TSIGSecret)
+	if in.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected update to succeed, but got [%s]", dns.RcodeToString[in.Rcode])
+	}
+	if in.IsTsig() == nil {
+		t.Errorf("Expected signed reply to signed update")
+	}
+	txts, _ := db.GetTXTForDomain(atxt.Subdomain)
+	if txts[0]+txts[1] != value {
+		t.Errorf("Expected update to store [%s], but got %v", value, txts)
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate("auth.example.org.")
+	m.Remove([]dns.RR{txt(name, value)})
+	if in = sendUpdate(t, m, key, atxt.TSIGSecret); in.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected delete to succeed, but got [%s]", dns.RcodeToString[in.Rcode])
+	}
+	txts, _ = db.GetTXTForDomain(atxt.Subdomain)
+	if txts[0]+txts[1] != "" {
+		t.Errorf("Expected delete to clear the value, but got %v", txts)
+	}
+
+	_ = db.Update(&model.ACMETxtPost{Subdomain: atxt.Subdomain, Value: value})
+	m = new(dns.Msg)
+	m.SetUpdate("auth.example.org.")
+	m.RemoveRRset([]dns.RR{txt(name, value)})
+	if in = sendUpdate(t, m, key, atxt.TSIGSecret); in.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected RRset delete to succeed, but got [%s]", dns.RcodeToString[in.Rcode])
+	}
+	txts, _ = db.GetTXTForDomain(atxt.Subdomain)
+	if txts[0]+txts[1] != "" {
+		t.Errorf("Expected RRset delete to clear the values, but got %v", txts)
+	}
+
+	for _, test := range []struct {
+		name   string
+		zone   string
+		rr     dns.RR
+		prereq bool
+		key    string
+		secret string
+		rcode  int
+	}{
+		{"unsigned", "auth.example.org.", txt(name, value), false, "", "", dns.RcodeRefused},
+		{"bad secret", "auth.example.org.", txt(name, value), false, key, other.TSIGSecret, dns.RcodeNotAuth},
+		{"unknown key", "auth.example.org.", txt(name, value), false, "nobody.", atxt.TSIGSecret, dns.RcodeNotAuth},
+		{"other account", "auth.example.org.", txt(other.Subdomain+".auth.example.org.", value), false, key, atxt.TSIGSecret, dns.RcodeRefused},
+		{"other type", "auth.example.org.", &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}}, false, key, atxt.TSIGSecret, dns.RcodeRefused},
+		{"invalid value", "auth.example.org.", txt(name, "short"), false, key, atxt.TSIGSecret, dns.RcodeRefused},
+		{"outside zone", "auth.example.org.", txt("example.com.", value), false, key, atxt.TSIGSecret, dns.RcodeNotZone},
+		{"unknown zone", "example.com.", txt(name, value), false, key, atxt.TSIGSecret, dns.RcodeNotAuth},
+		{"prerequisite", "auth.example.org.", txt(name, value), true, key, atxt.TSIGSecret, dns.RcodeNotImplemented},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetUpdate(test.zone)
+			m.Insert([]dns.RR{test.rr})
+			if test.prereq {
+				m.RRsetUsed([]dns.RR{test.rr})
+			}
+			if in := sendUpdate(t, m, test.key, test.secret); in.Rcode != test.rcode {
+				t.Errorf("Expected [%s], but got [%s]", dns.RcodeToString[test.rcode], dns.RcodeToString[in.Rcode])
+			}
+		})
+	}
+	txts, _ = db.GetTXTForDomain(atxt.Subdomain)
+	if txts[0]+txts[1] != "" {
+		t.Errorf("Expected rejected updates to change nothing, but got %v", txts)
+	}
+}
+
+func TestUpdateAllowFrom(t *testing.T) {
+	config := setupConfig()
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	_, stop := setupDNSServer(config, logger, db)
+	defer stop()
+
+	allowFrom, _ := model.ParseCIDRSlice([]string{"192.0.2.0/24"})
+	atxt, err := db.Register(allowFrom, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	rr, _ := dns.NewRR(atxt.Subdomain + ".auth.example.org. 60 TXT ______________valid_response_______________")
+	m := new(dns.Msg)
+	m.SetUpdate("auth.example.org.")
+	m.Insert([]dns.RR{rr})
+	if in := sendUpdate(t, m, atxt.Username.String()+".", atxt.TSIGSecret); in.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected update from disallowed address to be refused, but got [%s]", dns.RcodeToString[in.Rcode])
+	}
+}
+
+func TestNotImplementedOpcode(t *testing.T) {
+	config := setupConfig()
+	logger := zaptest.NewLogger(t)
+	_, stop := setupDNSServer(config, logger, nil)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetNotify("auth.example.org.")
+	in, err := dns.Exchange(m, "127.0.0.1:15353")
+	if err != nil {
+		t.Fatalf("Error querying the server [%v]", err)
+	}
+	if in.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("Expected NOTIMP for NOTIFY, but got [%s]", dns.RcodeToString[in.Rcode])
+	}
+}
@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// zoneData holds the records a DNSServer answers with. It is not modified once
+// published, reloading the records replaces it as a whole.
+type zoneData struct {
+	domains map[string]Records
+	// soa is the SOA record of the default zone
+	soa dns.RR
+	// zones maps the name of each zone served to its SOA record
+	zones map[string]dns.RR
+	// signers holds the DNSSEC signer of each signed zone
+	signers    map[string]*ZoneSigner
+	txtTTL     uint32
+	maxUDPSize uint16
+}
+
+func newZoneData() *zoneData {
+	return &zoneData{
+		domains:    make(map[string]Records),
+		zones:      make(map[string]dns.RR),
+		signers:    make(map[string]*ZoneSigner),
+		txtTTL:     DefaultTXTTTL,
+		maxUDPSize: DefaultMaxUDPSize,
+	}
+}
+
+// clone returns a copy of the zone data that can be modified without affecting
+// the original
+func (z *zoneData) clone() *zoneData {
+	c := *z
+	c.domains = make(map[string]Records, len(z.domains))
+	for name, records := range z.domains {
+		c.domains[name] = Records{append([]dns.RR{}, records.Records...)}
+	}
+	c.zones = make(map[string]dns.RR, len(z.zones))
+	for name, soa := range z.zones {
+		c.zones[name] = soa
+	}
+	c.signers = make(map[string]*ZoneSigner, len(z.signers))
+	for name, signer := range z.signers {
+		c.signers[name] = signer
+	}
+	return &c
+}
+
+// zoneStore publishes the zone data of one or more servers
+type zoneStore struct {
+	v atomic.Value
+}
+
+func newZoneStore() *zoneStore {
+	s := new(zoneStore)
+	s.v.Store(newZoneData())
+	return s
+}
+
+func (s *zoneStore) load() *zoneData {
+	return s.v.Load().(*zoneData)
+}
+
+func (s *zoneStore) store(z *zoneData) {
+	s.v.Store(z)
+}
+
+// zone returns the records currently being served
+func (d *DNSServer) zone() *zoneData {
+	return d.zones.load()
+}
+
+// ShareRecords makes the server answer with the records of another server, so that
+// they only need to be parsed once for all listeners. Reloading the records of
+// either server changes them for both.
+func (d *DNSServer) ShareRecords(other *DNSServer) {
+	d.zones = other.zones
+}
+
+// ParseRecords parses the static records and zone files, and creates the SOA
+// records of all zones. An invalid entry of dns.records or any error in a zone
+// file is returned.
+func (d *DNSServer) ParseRecords(config *Config) error {
+	z, err := d.parseZones(config)
+	if err != nil {
+		return err
+	}
+	d.zones.store(z)
+	d.bumpSerial()
+	return nil
+}
+
+// Reload replaces the records served with those of the config, including the
+// DNSSEC keys. Queries are answered from the old records until the new ones are
+// complete, and the old records are kept if there is any error.
+func (d *DNSServer) Reload(config *Config) error {
+	z, err := d.parseZones(config)
+	if err != nil {
+		return err
+	}
+	if err = d.loadSigners(z, config); err != nil {
+		return err
+	}
+	d.zones.store(z)
+	d.bumpSerial()
+	d.logger.Info("Reloaded records", zap.Int("names", len(z.domains)))
+	return nil
+}
+
+// bumpSerial makes sure secondaries notice that the records may have changed. The
+// time based serial is only used if there is no database to keep one in.
+func (d *DNSServer) bumpSerial() {
+	if d.DB != nil {
+		if err := d.DB.BumpSerial(); err != nil {
+			d.logger.Warn("Could not increment zone serial", zap.Error(err))
+		}
+	}
+}
+
+func (d *DNSServer) parseZones(config *Config) (*zoneData, error) {
+	config.SetDefaults()
+	z := newZoneData()
+	z.txtTTL = config.TXTTTL
+	z.maxUDPSize = config.MaxUDPSize
+	zones := config.AllZones()
+	for _, zone := range zones {
+		for _, v := range zone.StaticRecords {
+			rr, err := dns.NewRR(strings.ToLower(v))
+			if err != nil {
+				return nil, fmt.Errorf("While parsing record %q: %w", v, err)
+			}
+			// Add parsed RR
+			d.appendRR(z, rr)
+		}
+		if zone.ZoneFile != "" {
+			if err := d.readZoneFile(z, zone); err != nil {
+				return nil, err
+			}
+		}
+	}
+	serial := time.Now().Format("2006010215")
+	for i, zone := range zones {
+		// Add SOA
+		SOAstring := fmt.Sprintf("%s. %d SOA %s. %s. %s %d %d %d %d",
+			NormalizeZone(zone.Domain), zone.SOATTL, NormalizeZone(zone.NSName), NormalizeZone(zone.NSAdmin), serial,
+			zone.SOARefresh, zone.SOARetry, zone.SOAExpire, zone.SOAMinimum)
+		soarr, err := dns.NewRR(SOAstring)
+		if err != nil {
+			d.logger.Error("While adding SOA record", zap.Error(err), zap.String("soa", SOAstring))
+			continue
+		}
+		d.appendRR(z, soarr)
+		z.zones[soarr.Header().Name] = soarr
+		if i == 0 {
+			z.soa = soarr
+		}
+	}
+	return z, nil
+}
+
+// readZoneFile adds the records of a master file (RFC 1035) to the zone data. The
+// origin defaults to the zone, and the SOA record is replaced by the one built from
+// the config.
+func (d *DNSServer) readZoneFile(z *zoneData, zone ZoneConfig) error {
+	f, err := os.Open(zone.ZoneFile)
+	if err != nil {
+		return fmt.Errorf("While reading zone file: %w", err)
+	}
+	defer f.Close()
+	origin := NormalizeZone(zone.Domain) + "."
+	zp := dns.NewZoneParser(f, origin, zone.ZoneFile)
+	zp.SetDefaultTTL(zone.SOAMinimum)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		name := rr.Header().Name
+		if !dns.IsSubDomain(origin, name) {
+			return fmt.Errorf("%s: record %s is outside of zone %s", zone.ZoneFile, name, origin)
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			if name != origin {
+				return fmt.Errorf("%s: SOA record %s is not at the zone apex", zone.ZoneFile, name)
+			}
+			continue
+		}
+		d.appendRR(z, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("While parsing zone file: %w", err)
+	}
+	return nil
+}
+
+func (d *DNSServer) appendRR(z *zoneData, rr dns.RR) {
+	addDomain := rr.Header().Name
+	drecs := z.domains[addDomain]
+	drecs.Records = append(drecs.Records, rr)
+	z.domains[addDomain] = drecs
+	d.logger.Debug("Adding new record to domain", zap.String("recordtype", dns.TypeToString[rr.Header().Rrtype]), zap.String("domain", addDomain))
+}
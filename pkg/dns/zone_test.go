@@ -0,0 +1,168 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap/zaptest"
+)
+
+func writeZoneFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "auth.example.org.zone")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Could not write zone file: [%v]", err)
+	}
+	return path
+}
+
+func TestZoneFile(t *testing.T) {
+	config := setupConfig()
+	config.ZoneFile = writeZoneFile(t, `$TTL 600
+@	SOA	ns.elsewhere.org. hostmaster.elsewhere.org. 1 2 3 4 5
+	MX	10 mail
+mail	A	192.0.2.25
+WWW	300	CNAME	mail.auth.example.org.
+$ORIGIN sub.auth.example.org.
+host	AAAA	2001:db8::1
+`)
+	logger := zaptest.NewLogger(t)
+	dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	if err := dnsServer.ParseRecords(&config); err != nil {
+		t.Fatalf("Unexpected error parsing zone file [%v]", err)
+	}
+	z := dnsServer.zone()
+
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+		ttl   uint32
+	}{
+		{"auth.example.org.", dns.TypeMX, 600},
+		{"mail.auth.example.org.", dns.TypeA, 600},
+		{"www.auth.example.org.", dns.TypeCNAME, 300},
+		{"host.sub.auth.example.org.", dns.TypeAAAA, 600},
+		// Static records of the config are kept alongside
+		{"ns1.auth.example.org.", dns.TypeA, 3600},
+	} {
+		found := false
+		for _, rr := range z.domains[test.name].Records {
+			if rr.Header().Rrtype == test.qtype {
+				found = true
+				if rr.Header().Ttl != test.ttl {
+					t.Errorf("Expected TTL %d for %s, but got %d", test.ttl, test.name, rr.Header().Ttl)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Expected %s record for %s, but got %v", dns.TypeToString[test.qtype], test.name, z.domains[test.name].Records)
+		}
+	}
+
+	// The SOA record of the zone file is replaced by the one from the config
+	soas := 0
+	for _, rr := range z.domains["auth.example.org."].Records {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soas++
+			if soa.Ns != "ns1.auth.example.org." {
+				t.Errorf("Expected SOA from config, but got %s", soa)
+			}
+		}
+	}
+	if soas != 1 {
+		t.Errorf("Expected exactly one SOA record, but got %d", soas)
+	}
+}
+
+func TestZoneFileErrors(t *testing.T) {
+	for i, test := range []struct {
+		content string
+		err     string
+	}{
+		{"www A 192.0.2.1\nbroken A not-an-address\n", "While parsing zone file"},
+		{"www.example.com. A 192.0.2.1\n", "outside of zone"},
+		{"sub SOA ns.example.org. admin.example.org. 1 2 3 4 5\n", "not at the zone apex"},
+	} {
+		config := setupConfig()
+		config.ZoneFile = writeZoneFile(t, test.content)
+		logger := zaptest.NewLogger(t)
+		dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+		err := dnsServer.ParseRecords(&config)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Test %d: Expected error containing %q, but got [%v]", i, test.err, err)
+		}
+	}
+
+	config := setupConfig()
+	config.StaticRecords = append(config.StaticRecords, "broken.auth.example.org. A not-an-address")
+	logger := zaptest.NewLogger(t)
+	dnsServer := NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	if err := dnsServer.ParseRecords(&config); err == nil || !strings.Contains(err.Error(), "While parsing record") {
+		t.Errorf("Expected error for invalid static record, but got [%v]", err)
+	}
+
+	config = setupConfig()
+	config.ZoneFile = filepath.Join(t.TempDir(), "missing.zone")
+	dnsServer = NewDNSServer(logger, nil, config.Listen, config.Proto, config.Domain)
+	if err := dnsServer.ParseRecords(&config); err == nil {
+		t.Errorf("Expected error for missing zone file")
+	}
+}
+
+func TestReload(t *testing.T) {
+	config := setupConfig()
+	config.ZoneFile = writeZoneFile(t, "old A 192.0.2.1\n")
+	logger := zaptest.NewLogger(t)
+	db := setupDB(t, logger)
+	dnsServer, stop := setupDNSServer(config, logger, db)
+	defer stop()
+	// Servers sharing the records see the reload too
+	other := NewDNSServer(logger, db, config.Listen, "tcp", config.Domain)
+	other.ShareRecords(dnsServer)
+
+	serial, err := db.GetSerial()
+	if err != nil {
+		t.Fatalf("Could not get serial: [%v]", err)
+	}
+	resolv := resolver{server: "127.0.0.1:15353"}
+
+	// A broken zone file keeps the old records
+	broken := setupConfig()
+	broken.ZoneFile = writeZoneFile(t, "new A not-an-address\n")
+	if err := dnsServer.Reload(&broken); err == nil {
+		t.Errorf("Expected error reloading broken zone file")
+	}
+	if answer, err := resolv.lookup("old.auth.example.org", dns.TypeA); err != nil || len(answer.Answer) != 1 {
+		t.Errorf("Expected old record to be kept, but got %v [%v]", answer, err)
+	}
+
+	// So does a broken static record
+	broken = setupConfig()
+	broken.StaticRecords = append(broken.StaticRecords, "new.auth.example.org. A not-an-address")
+	if err := dnsServer.Reload(&broken); err == nil {
+		t.Errorf("Expected error reloading broken static record")
+	}
+	if answer, err := resolv.lookup("old.auth.example.org", dns.TypeA); err != nil || len(answer.Answer) != 1 {
+		t.Errorf("Expected old record to be kept, but got %v [%v]", answer, err)
+	}
+
+	reloaded := setupConfig()
+	reloaded.ZoneFile = writeZoneFile(t, "new A 192.0.2.2\n")
+	if err := dnsServer.Reload(&reloaded); err != nil {
+		t.Fatalf("Unexpected error reloading records [%v]", err)
+	}
+	if answer, err := resolv.lookup("new.auth.example.org", dns.TypeA); err != nil || len(answer.Answer) != 1 {
+		t.Errorf("Expected new record after reload, but got %v [%v]", answer, err)
+	}
+	if answer, _ := resolv.lookup("old.auth.example.org", dns.TypeA); answer == nil || answer.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected old record to be gone after reload, but got %v", answer)
+	}
+	if _, ok := other.zone().domains["new.auth.example.org."]; !ok {
+		t.Errorf("Expected shared records to be reloaded")
+	}
+	if newSerial, err := db.GetSerial(); err != nil || !serialLess(serial, newSerial) {
+		t.Errorf("Expected serial to increase after reload, but got %d -> %d [%v]", serial, newSerial, err)
+	}
+}
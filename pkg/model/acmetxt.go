@@ -14,6 +14,11 @@ type ACMETxt struct {
 	Password string
 	ACMETxtPost
 	AllowFrom CIDRSlice
+	// Zone is the zone the account was registered in. Empty for the default zone.
+	Zone string `json:"zone"`
+	// TSIGSecret is the base64 encoded secret of the TSIG key authenticating RFC 2136
+	// updates for the account. Empty for accounts registered before it was introduced.
+	TSIGSecret string `json:"-"`
 }
 
 // ACMETxtPost holds the DNS part of the ACMETxt struct
@@ -27,9 +32,14 @@ func NewACMETxt() (*ACMETxt, error) {
 	if err != nil {
 		return nil, err
 	}
+	tsigSecret, err := generateTSIGSecret()
+	if err != nil {
+		return nil, err
+	}
 	a := new(ACMETxt)
 	a.Username = uuid.New()
 	a.Password = password
+	a.TSIGSecret = tsigSecret
 	a.Subdomain = uuid.New().String()
 	return a, nil
 }
@@ -49,3 +59,13 @@ func generatePassword() (string, error) {
 	}
 	return base64.URLEncoding.EncodeToString(bs), nil
 }
+
+func generateTSIGSecret() (string, error) {
+	// 32 bytes, the output size of HMAC-SHA256
+	bs := make([]byte, 32)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(bs), nil
+}